@@ -7,6 +7,7 @@ import (
 	"os"
 	"path"
 	"strings"
+	"time"
 
 	"github.com/ansel1/merry/v2"
 	"trading212-parser.kimi450.com/pkg"
@@ -39,17 +40,25 @@ func (i *arrayFlags) Set(value string) error {
 }
 
 type ScriptArgs struct {
+	Command string
+
 	LogBundleBaseDir string
 	LoggingLevel     int
 
 	Config       string
 	AllowTickers arrayFlags
 	SkipTickers  arrayFlags
+	AsOf         time.Time
 }
 
 func (scriptArgs *ScriptArgs) parseArgs() error {
 	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Usage of %s: [flags] [command]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Commands:\n")
+		fmt.Fprintf(os.Stderr, "  %s\n\tCalculate the tax liability (default)\n", pkg.CalculateCommand)
+		fmt.Fprintf(os.Stderr, "  %s\n\tList the upcoming 8 year deemed disposals of fund holdings\n", pkg.DeemedDisposalsCommand)
+		fmt.Fprintf(os.Stderr, "  %s\n\tCheck the inputs for errors without calculating any tax\n", pkg.ValidateCommand)
+		fmt.Fprintf(os.Stderr, "Flags:\n")
 
 		flag.PrintDefaults()
 	}
@@ -76,8 +85,21 @@ func (scriptArgs *ScriptArgs) parseArgs() error {
 		path.Join(cwd, "configs", "config.json"),
 		"Location of the script's config")
 
+	asOf := flag.String("as-of", time.Now().Format(time.DateOnly),
+		"Date (YYYY-MM-DD) the deemed disposals and corporate actions are processed up to")
+
 	flag.Parse()
 
+	scriptArgs.Command = pkg.CalculateCommand
+	if flag.NArg() > 0 {
+		scriptArgs.Command = flag.Arg(0)
+	}
+	if scriptArgs.Command != pkg.CalculateCommand &&
+		scriptArgs.Command != pkg.DeemedDisposalsCommand &&
+		scriptArgs.Command != pkg.ValidateCommand {
+		return merry.Errorf("unknown command '%s'", scriptArgs.Command)
+	}
+
 	scriptArgs.LogBundleBaseDir = *logBundleBaseDir
 	scriptArgs.LoggingLevel = *loggingLevel
 
@@ -85,6 +107,11 @@ func (scriptArgs *ScriptArgs) parseArgs() error {
 	scriptArgs.AllowTickers = allowTickers
 	scriptArgs.SkipTickers = skipTickers
 
+	scriptArgs.AsOf, err = time.Parse(time.DateOnly, *asOf)
+	if err != nil {
+		return merry.Errorf("failed to parse as-of date '%s': %w", *asOf, err)
+	}
+
 	return nil
 }
 
@@ -115,5 +142,5 @@ func main() {
 		panic(fmt.Errorf("failed to validate args: %w", err))
 	}
 
-	pkg.Process(scriptArgs.LogBundleBaseDir, scriptArgs.LoggingLevel, scriptArgs.Config, scriptArgs.AllowTickers, scriptArgs.SkipTickers)
+	pkg.Process(scriptArgs.Command, scriptArgs.LogBundleBaseDir, scriptArgs.LoggingLevel, scriptArgs.Config, scriptArgs.AllowTickers, scriptArgs.SkipTickers, scriptArgs.AsOf)
 }
@@ -5,9 +5,13 @@ import (
 	"os"
 
 	"github.com/ansel1/merry/v2"
+	"github.com/shopspring/decimal"
+	"trading212-parser.kimi450.com/pkg/tax"
 )
 
 type HistoryFile struct {
+	// Year is the tax year the file is declared for, 0 when it is not
+	// declared. The year of each record comes from its time.
 	Year int `json:"Year"`
 
 	Path string `json:"Path"`
@@ -17,6 +21,44 @@ type HistoryFile struct {
 type Config struct {
 	// Items that are in the file
 	HistoryFiles []HistoryFile `json:"historyFiles"`
+
+	// HistoryPaths are directories or globs of history files, the files
+	// found are read along with HistoryFiles
+	HistoryPaths []string `json:"historyPaths"`
+
+	// TaxParameters override or add to the built in rates by year
+	TaxParameters []tax.Parameters `json:"taxParameters"`
+
+	// TreatyRates override or add to the built in dividend withholding tax
+	// treaty rates by ISIN country prefix, e.g. "US"
+	TreatyRates map[string]decimal.Decimal `json:"treatyRates"`
+
+	// PricesFile is the local price file used to value deemed disposals
+	PricesFile string `json:"pricesFile"`
+
+	// ClassificationFile maps instruments to their asset class
+	ClassificationFile string `json:"classificationFile"`
+
+	// CorporateActionsFile adds splits and identifier changes to the built
+	// in ones
+	CorporateActionsFile string `json:"corporateActionsFile"`
+
+	// AdjustmentsFile holds manual reductions of the cost of the shares held,
+	// e.g. returns of capital missing from the export
+	AdjustmentsFile string `json:"adjustmentsFile"`
+
+	// OpeningLotsFile holds the shares transferred in from another broker,
+	// processed before the history files
+	OpeningLotsFile string `json:"openingLotsFile"`
+
+	// ManualTransactionsFile holds buys and sells missing from the exports,
+	// e.g. inheritances and gifts
+	ManualTransactionsFile string `json:"manualTransactionsFile"`
+
+	// LenientParsing lists every value of the history files that can not be
+	// parsed, instead of stopping at the first one. No tax is calculated when
+	// there are any.
+	LenientParsing bool `json:"lenientParsing"`
 }
 
 // ParseConfigFile reads and marshals the file into a Config type struct
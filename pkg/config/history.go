@@ -0,0 +1,68 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/ansel1/merry/v2"
+)
+
+// GetHistoryFiles returns the history files listed in the config followed
+// by the CSV files found in the directories and globs of HistoryPaths. The
+// files found have no declared year, and a file is only returned once.
+func (c *Config) GetHistoryFiles() ([]HistoryFile, error) {
+	historyFiles := []HistoryFile{}
+	seen := map[string]bool{}
+	for _, historyFile := range c.HistoryFiles {
+		seen[filepath.Clean(historyFile.Path)] = true
+		historyFiles = append(historyFiles, historyFile)
+	}
+
+	for _, historyPath := range c.HistoryPaths {
+		paths, err := findHistoryFiles(historyPath)
+		if err != nil {
+			return nil, merry.Errorf("failed to find history files in '%s': %w", historyPath, err)
+		}
+		if len(paths) == 0 {
+			return nil, merry.Errorf("no history files found in '%s'", historyPath)
+		}
+
+		for _, path := range paths {
+			if seen[filepath.Clean(path)] {
+				continue
+			}
+			seen[filepath.Clean(path)] = true
+			historyFiles = append(historyFiles, HistoryFile{Path: path})
+		}
+	}
+	return historyFiles, nil
+}
+
+// findHistoryFiles returns the CSV files in the directory, or the files
+// matching the glob, sorted by path
+func findHistoryFiles(historyPath string) ([]string, error) {
+	pattern := historyPath
+	info, err := os.Stat(historyPath)
+	if err == nil && info.IsDir() {
+		pattern = filepath.Join(historyPath, "*.csv")
+	}
+
+	paths, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, merry.Errorf("failed to match '%s': %w", pattern, err)
+	}
+
+	files := []string{}
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, merry.Errorf("failed to stat '%s': %w", path, err)
+		}
+		if !info.IsDir() {
+			files = append(files, path)
+		}
+	}
+	slices.Sort(files)
+	return files, nil
+}
@@ -1,28 +1,92 @@
 package pkg
 
 import (
-	"cmp"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"os"
 	"path"
 	"slices"
+	"time"
 
 	"github.com/ansel1/merry/v2"
 	"github.com/go-logr/logr"
 	"trading212-parser.kimi450.com/pkg/config"
 	"trading212-parser.kimi450.com/pkg/logging"
+	"trading212-parser.kimi450.com/pkg/tax"
 	"trading212-parser.kimi450.com/pkg/trading212"
 )
 
 type Report struct {
-	ProfitsData          map[int]trading212.StockSummary
-	SaleAggregatesData   map[int]trading212.StockSummary
+	ProfitsData        map[int]trading212.StockSummary
+	SaleAggregatesData map[int]trading212.StockSummary
+	// LossAggregatesData only holds the allowable losses
 	LossAggregatesData   map[int]trading212.StockSummary
 	ProfitAggregatesData map[int]trading212.StockSummary
+	// RestrictedLossAggregatesData holds the losses ring-fenced under s581(3)
+	// that can only be offset against gains on the reacquired shares
+	RestrictedLossAggregatesData map[int]trading212.StockSummary
+	// DisposalsData lists every sale with the acquisition lots it was
+	// matched against so the calculation can be submitted with the return
+	DisposalsData map[int][]trading212.Disposal
+	// PeriodSummariesData splits the summaries above by payment period
+	PeriodSummariesData map[int]map[trading212.Period]trading212.PeriodSummary
+	// LiabilitiesData is the CGT due per year after losses and the exemption,
+	// funds are not part of it
+	LiabilitiesData map[int]tax.Liability
+	// FundTaxData is the exit tax due per year on fund disposals
+	FundTaxData map[int]tax.FundTax
+	// DividendsData is the dividend income per year, by country, with the
+	// withholding tax that can be credited
+	DividendsData map[int]tax.DividendIncome
+	// FundIncomeData is the exit tax due per year on fund distributions, they
+	// are not part of the dividends
+	FundIncomeData map[int]tax.FundIncome
+	// DeemedDisposalsData lists the 8 year deemed disposals of fund holdings
+	DeemedDisposalsData map[int][]trading212.DeemedDisposal
+	// UpcomingDeemedDisposals lists the next anniversary of every fund lot
+	// still held
+	UpcomingDeemedDisposals []trading212.DeemedDisposal
+	// UnclassifiedInstruments lists the instruments missing from the
+	// classification registry and the funds that are not UCITS funds, with
+	// the asset class they were processed as
+	UnclassifiedInstruments []trading212.UnclassifiedInstrument
+	// CorporateActionsData lists the corporate actions applied to each record
+	CorporateActionsData []trading212.AppliedCorporateAction
+	// InstrumentsData lists every instrument with the ISINs and tickers it
+	// was seen with
+	InstrumentsData []trading212.Instrument
+	// TickerCollisionsData lists the new ISINs seen with the ticker of shares
+	// held under another ISIN, to be confirmed as different instruments or
+	// joined with an isin-change corporate action
+	TickerCollisionsData []trading212.TickerCollision
+	// CostAdjustmentsData lists the returns of capital and manual cost
+	// adjustments taken off the cost of the shares held
+	CostAdjustmentsData []trading212.CostAdjustment
+	// ManualTransactionsData lists the transactions from the manual
+	// transactions file, they are also flagged on the disposals
+	ManualTransactionsData []trading212.ManualTransaction
+	// Years lists every tax year with disposals or income, in order
+	Years []int
+	// HistoryFilesData lists the history files read with the years of their
+	// records
+	HistoryFilesData []HistoryFileSummary
+	// CellErrorsData lists the values of the history files that could not be
+	// parsed, only in lenient mode as they fail the run otherwise. No tax
+	// figures are worked out when there are any.
+	CellErrorsData []trading212.CellError
+	// DuplicatesData lists the records dropped as they were already read
+	// from another file or earlier in the same one
+	DuplicatesData []trading212.DuplicateRecord
 }
 
+const (
+	CalculateCommand       = "calculate"
+	DeemedDisposalsCommand = "deemed-disposals"
+	ValidateCommand        = "validate"
+)
+
 func getLog(logBundleBaseDir string, loggingLevel int) (logr.Logger, string, error) {
 	logBundleDir := path.Join(logBundleBaseDir,
 		config.GetDateTimePrefixForFile()+"-log-bundle")
@@ -42,8 +106,10 @@ func getLog(logBundleBaseDir string, loggingLevel int) (logr.Logger, string, err
 	return log, logBundleDir, nil
 }
 
-func Process(logBundleBaseDir string, loggingLevel int,
-	configFilePath string, allowTickers, skipTickers []string) {
+// Process runs the command. Mergers and deemed disposals are processed up to
+// asOf, and the upcoming deemed disposals are the ones after it.
+func Process(command string, logBundleBaseDir string, loggingLevel int,
+	configFilePath string, allowTickers, skipTickers []string, asOf time.Time) {
 	var err error
 	log := logr.FromContextOrDiscard(context.TODO())
 	logBundleDir := ""
@@ -57,10 +123,12 @@ func Process(logBundleBaseDir string, loggingLevel int,
 	log.V(0).Info("log bundle directory", "filePath", logBundleDir)
 
 	log.V(0).Info("running",
+		"command", command,
 		"logBundleDir", logBundleDir,
 		"configFilePath", configFilePath,
 		"allowTickers", allowTickers,
-		"skipTickers", skipTickers)
+		"skipTickers", skipTickers,
+		"asOf", asOf.Format(time.DateOnly))
 
 	configData, err := config.ParseConfigFile(configFilePath)
 	if err != nil {
@@ -68,105 +136,707 @@ func Process(logBundleBaseDir string, loggingLevel int,
 		os.Exit(1)
 	}
 
-	_ = processAllHistoryFiles(log, allowTickers, skipTickers, *configData)
+	if command == ValidateCommand {
+		report := validateInputs(log, *configData, asOf)
+		logValidationReport(log, report)
+		if report.HasErrors() {
+			os.Exit(1)
+		}
+		return
+	}
+
+	summary := processAllHistoryFiles(log, allowTickers, skipTickers, *configData, asOf)
+	if len(summary.CellErrorsData) > 0 {
+		os.Exit(1)
+	}
+
+	if command == DeemedDisposalsCommand {
+		logUpcomingDeemedDisposals(log, summary)
+		return
+	}
+
+	if logBundleDir != "" {
+		err = writeDisposals(log, logBundleDir, summary)
+		if err != nil {
+			log.Error(err, "failed to write disposals")
+			os.Exit(1)
+		}
+	}
+}
+
+// logUpcomingDeemedDisposals lists the next anniversary of every fund lot
+// still held so the tax can be budgeted for
+func logUpcomingDeemedDisposals(log logr.Logger, summary Report) {
+	for _, deemedDisposal := range summary.UpcomingDeemedDisposals {
+		log.V(0).Info("upcoming deemed disposal",
+			"date", deemedDisposal.Date.Format(time.DateOnly),
+			"ticker", deemedDisposal.Ticker,
+			"isin", deemedDisposal.Isin,
+			"acquired", deemedDisposal.AcquiredAt.Format(time.DateOnly),
+			"quantity", deemedDisposal.Quantity,
+			"cost", deemedDisposal.Cost,
+			"priced", deemedDisposal.Priced,
+			"current value", deemedDisposal.MarketValue,
+			"current gain", deemedDisposal.Gain,
+		)
+	}
+}
+
+// writeDisposals dumps the per-disposal lot matching to the log bundle
+func writeDisposals(log logr.Logger, logBundleDir string, summary Report) error {
+	filePath := path.Join(logBundleDir,
+		fmt.Sprintf("%s-disposals.json", config.GetDateTimePrefixForFile()))
+
+	data, err := json.MarshalIndent(summary.DisposalsData, "", "    ")
+	if err != nil {
+		return merry.Errorf("failed to marshal disposals: %w", err)
+	}
+
+	err = os.WriteFile(filePath, data, 0644)
+	if err != nil {
+		return merry.Errorf("failed to write disposals file: %w", err)
+	}
+
+	log.V(0).Info("disposals written", "filePath", filePath)
+	return nil
+}
+
+// HistoryFileSummary describes a history file that was read
+type HistoryFileSummary struct {
+	Path string
+	// DeclaredYear is the year set for the file in the config, 0 if none
+	DeclaredYear int
+	Years        []int
+	// RowsOutsideYear is the number of rows not in the declared year
+	RowsOutsideYear int
+	// Schema is the layout detected from the header, ExtraColumns the
+	// headers that are not mapped to a record field
+	Schema       trading212.SchemaVersion
+	ExtraColumns []string
 }
 
-func processAllHistoryFiles(log logr.Logger, allowTickers, skipTickers []string, configData config.Config) Report {
+func processAllHistoryFiles(log logr.Logger, allowTickers, skipTickers []string, configData config.Config,
+	asOf time.Time) Report {
 	summary := Report{
 		ProfitsData:          make(map[int]trading212.StockSummary),
 		SaleAggregatesData:   make(map[int]trading212.StockSummary),
 		LossAggregatesData:   make(map[int]trading212.StockSummary),
 		ProfitAggregatesData: make(map[int]trading212.StockSummary),
+		DisposalsData:        make(map[int][]trading212.Disposal),
+
+		RestrictedLossAggregatesData: make(map[int]trading212.StockSummary),
+		PeriodSummariesData:          make(map[int]map[trading212.Period]trading212.PeriodSummary),
+		LiabilitiesData:              make(map[int]tax.Liability),
+		FundTaxData:                  make(map[int]tax.FundTax),
+		DividendsData:                make(map[int]tax.DividendIncome),
+		FundIncomeData:               make(map[int]tax.FundIncome),
+		DeemedDisposalsData:          make(map[int][]trading212.DeemedDisposal),
 	}
-	bookkeeper := trading212.NewBookkeeper()
+	parameterTable := tax.NewParameterTable(configData.TaxParameters)
 
-	// sort files by year to ensure correct processing
-	slices.SortFunc(configData.HistoryFiles, func(first, second config.HistoryFile) int {
-		return cmp.Compare(first.Year, second.Year)
-	})
+	referenceData, err := loadReferenceData(configData, parameterTable)
+	if err != nil {
+		log.Error(err, "failed to load the reference data")
+		os.Exit(1)
+	}
+	bookkeeper := trading212.NewBookkeeperFromReferenceData(referenceData)
 
-	for _, historyFile := range configData.HistoryFiles {
-		log.V(0).Info("processing file", "year", historyFile.Year, "path", historyFile.Path)
+	records, err := readAllSources(log, &summary, configData)
+	if err != nil {
+		log.Error(err, "failed to read the inputs")
+		os.Exit(1)
+	}
 
-		saleAggregates, profitAggregates, lossAggregates, profits, err := processHistoryFile(log, bookkeeper, historyFile, allowTickers, skipTickers)
-		if err != nil {
-			log.Error(err, "failed to process file",
-				"year", historyFile.Year, "path", historyFile.Path)
-			os.Exit(1)
-		}
+	// the values that could not be parsed were read as zero, the figures
+	// worked out from them would be wrong
+	if len(summary.CellErrorsData) > 0 {
+		log.Error(merry.Errorf("%d values could not be parsed", len(summary.CellErrorsData)),
+			"no tax is calculated, fix the values listed and run again")
+		return summary
+	}
+
+	err = processAllRecords(log, bookkeeper, records, allowTickers, skipTickers, asOf)
+	if err != nil {
+		log.Error(err, "failed to process records")
+		os.Exit(1)
+	}
+
+	summary.Years = getReportYears(bookkeeper, records, asOf)
+	log.V(0).Info("years with disposals or income", "years", summary.Years)
+
+	// summaries are only read once everything is processed, as a reacquisition
+	// in a later file can ring-fence a loss from an earlier year
+	for _, year := range summary.Years {
+		profits := bookkeeper.GetProfitForYear(year)
+		saleAggregates := bookkeeper.GetSaleAggregatesForYear(year)
+		lossAggregates := bookkeeper.GetLossAggregatesForYear(year)
+		profitAggregates := bookkeeper.GetProfitAggregatesForYear(year)
+		restrictedLossAggregates := bookkeeper.GetRestrictedLossAggregatesForYear(year)
 
 		log.V(0).Info("summary",
-			"year", historyFile.Year,
+			"year", year,
 			"profits", profits,
 		)
 
 		log.V(0).Info("summary",
-			"year", historyFile.Year,
+			"year", year,
 			"sale aggregates", saleAggregates,
 		)
 
 		log.V(0).Info("summary",
-			"year", historyFile.Year,
+			"year", year,
 			"loss aggregates", lossAggregates,
 		)
 
 		log.V(0).Info("summary",
-			"year", historyFile.Year,
+			"year", year,
+			"restricted loss aggregates", restrictedLossAggregates,
+		)
+
+		log.V(0).Info("summary",
+			"year", year,
 			"profit aggregates", profitAggregates,
 		)
 
-		summary.ProfitsData[historyFile.Year] = profits
-		summary.SaleAggregatesData[historyFile.Year] = saleAggregates
-		summary.LossAggregatesData[historyFile.Year] = lossAggregates
-		summary.ProfitAggregatesData[historyFile.Year] = profitAggregates
+		summary.ProfitsData[year] = profits
+		summary.SaleAggregatesData[year] = saleAggregates
+		summary.LossAggregatesData[year] = lossAggregates
+		summary.ProfitAggregatesData[year] = profitAggregates
+		summary.RestrictedLossAggregatesData[year] = restrictedLossAggregates
+		summary.DisposalsData[year] = bookkeeper.GetDisposalsForYear(year)
+
+		summary.PeriodSummariesData[year] = make(map[trading212.Period]trading212.PeriodSummary)
+		for _, period := range trading212.Periods {
+			periodSummary := bookkeeper.GetSummaryForPeriod(year, period)
+
+			log.V(0).Info("period summary",
+				"year", year,
+				"period", period,
+				"profits", periodSummary.Profits,
+				"sale aggregates", periodSummary.SaleAggregates,
+				"loss aggregates", periodSummary.LossAggregates,
+				"restricted loss aggregates", periodSummary.RestrictedLossAggregates,
+				"profit aggregates", periodSummary.ProfitAggregates,
+			)
+
+			summary.PeriodSummariesData[year][period] = periodSummary
+		}
+	}
+
+	if len(records) > 0 {
+		// deemed disposals can fall in years without any records
+		for year := records[0].Time.Year(); year <= asOf.Year(); year++ {
+			deemedDisposals := bookkeeper.GetDeemedDisposalsForYear(year)
+			if len(deemedDisposals) > 0 {
+				summary.DeemedDisposalsData[year] = deemedDisposals
+			}
+		}
+	}
+	summary.UpcomingDeemedDisposals = bookkeeper.GetUpcomingDeemedDisposals(asOf)
+
+	summary.CorporateActionsData = bookkeeper.GetAppliedCorporateActions()
+	for _, applied := range summary.CorporateActionsData {
+		log.V(0).Info("corporate action applied",
+			"type", applied.Action.Type,
+			"effectiveDate", applied.Action.EffectiveDate,
+			"id", applied.RecordID,
+			"action", applied.RecordAction,
+			"date", applied.RecordTime.Format(time.DateOnly),
+			"ticker", applied.Ticker,
+			"quantityBefore", applied.QuantityBefore,
+			"quantityAfter", applied.QuantityAfter,
+		)
+	}
+
+	summary.CostAdjustmentsData = bookkeeper.GetCostAdjustments()
+	for _, adjustment := range summary.CostAdjustmentsData {
+		log.V(0).Info("cost adjustment",
+			"date", adjustment.Date.Format(time.DateOnly),
+			"ticker", adjustment.Ticker,
+			"source", adjustment.Source,
+			"amount", adjustment.Amount,
+			"cost reduction", adjustment.CostReduction,
+			"excess gain", adjustment.ExcessGain,
+		)
+	}
+
+	summary.InstrumentsData = bookkeeper.GetInstruments()
+	for _, instrument := range summary.InstrumentsData {
+		if len(instrument.Aliases) > 1 {
+			log.V(0).Info("instrument seen with several identifiers",
+				"instrument", instrument.Key,
+				"aliases", instrument.Aliases,
+			)
+		}
+	}
+
+	summary.TickerCollisionsData = bookkeeper.GetTickerCollisions()
+
+	summary.UnclassifiedInstruments = bookkeeper.GetUnclassifiedInstruments()
+	for _, instrument := range summary.UnclassifiedInstruments {
+		log.V(0).Info("unclassified instrument",
+			"ticker", instrument.Ticker,
+			"isin", instrument.Isin,
+			"name", instrument.Name,
+			"processedAs", instrument.Class,
+			"status", instrument.Status,
+		)
+	}
+
+	err = calculateLiabilities(log, &summary, parameterTable)
+	if err != nil {
+		log.Error(err, "failed to calculate liabilities")
+		os.Exit(1)
+	}
+
+	err = calculateFundTax(log, &summary, parameterTable)
+	if err != nil {
+		log.Error(err, "failed to calculate fund tax")
+		os.Exit(1)
+	}
+
+	calculateDividendIncome(log, &summary, tax.NewTreatyRates(configData.TreatyRates),
+		bookkeeper.GetDividends())
+
+	err = calculateFundIncome(log, &summary, parameterTable, bookkeeper.GetFundDistributions())
+	if err != nil {
+		log.Error(err, "failed to calculate fund income")
+		os.Exit(1)
 	}
 	return summary
 }
 
-func processHistoryFile(log logr.Logger, bookkeeper trading212.BookKeeper,
-	historyFile config.HistoryFile,
-	allowTickers, skipTickers []string) (trading212.StockSummary,
-	trading212.StockSummary,
-	trading212.StockSummary,
-	trading212.StockSummary, error) {
+// loadReferenceData reads the prices, classifications, corporate actions and
+// cost adjustments files of the config, the built in data is used for the
+// files that are not set
+func loadReferenceData(configData config.Config, parameterTable tax.ParameterTable) (trading212.ReferenceData, error) {
+	referenceData := trading212.ReferenceData{
+		Prices:           trading212.NewPriceBook(),
+		ExitTaxRates:     parameterTable,
+		Classifications:  trading212.NewClassificationRegistry(),
+		CorporateActions: trading212.NewCorporateActions(),
+		CostAdjustments:  []trading212.CostAdjustment{},
+	}
+
+	var err error
+	if configData.PricesFile != "" {
+		referenceData.Prices, err = trading212.LoadPriceBook(configData.PricesFile)
+		if err != nil {
+			return referenceData, merry.Errorf("failed to load prices '%s': %w", configData.PricesFile, err)
+		}
+	}
+
+	if configData.ClassificationFile != "" {
+		referenceData.Classifications, err = trading212.LoadClassificationRegistry(configData.ClassificationFile)
+		if err != nil {
+			return referenceData, merry.Errorf("failed to load classifications '%s': %w",
+				configData.ClassificationFile, err)
+		}
+	}
+
+	if configData.CorporateActionsFile != "" {
+		referenceData.CorporateActions, err = trading212.LoadCorporateActions(configData.CorporateActionsFile)
+		if err != nil {
+			return referenceData, merry.Errorf("failed to load corporate actions '%s': %w",
+				configData.CorporateActionsFile, err)
+		}
+	}
+
+	if configData.AdjustmentsFile != "" {
+		referenceData.CostAdjustments, err = trading212.LoadCostAdjustments(configData.AdjustmentsFile)
+		if err != nil {
+			return referenceData, merry.Errorf("failed to load adjustments '%s': %w", configData.AdjustmentsFile, err)
+		}
+	}
+	return referenceData, nil
+}
+
+// calculateLiabilities works out the CGT due per year from the chargeable
+// gains and allowable losses in the report. Funds fall under the exit tax
+// regime instead, so only the stock figures are used.
+func calculateLiabilities(log logr.Logger, summary *Report, parameterTable tax.ParameterTable) error {
+	yearlyGains := []tax.YearlyGains{}
+	for year, profitAggregates := range summary.ProfitAggregatesData {
+		yearlyGains = append(yearlyGains, tax.YearlyGains{
+			Year:   year,
+			Gains:  profitAggregates.Stock,
+			Losses: summary.LossAggregatesData[year].Stock,
 
+			InitialPeriodGains:  summary.PeriodSummariesData[year][trading212.InitialPeriod].ProfitAggregates.Stock,
+			InitialPeriodLosses: summary.PeriodSummariesData[year][trading212.InitialPeriod].LossAggregates.Stock,
+		})
+	}
+
+	liabilities, err := tax.CalculateLiabilities(parameterTable, yearlyGains)
+	if err != nil {
+		return merry.Errorf("failed to calculate liabilities: %w", err)
+	}
+
+	for _, liability := range liabilities {
+		log.V(0).Info("liability",
+			"year", liability.Year,
+			"gains", liability.Gains,
+			"current year losses used", liability.CurrentYearLossesUsed,
+			"losses brought forward used", liability.LossesBroughtForwardUsed,
+			"annual exemption used", liability.AnnualExemptionUsed,
+			"taxable gains", liability.TaxableGains,
+			"rate", liability.Rate,
+			"tax", liability.Tax,
+			"losses carried forward", liability.LossesCarriedForward,
+		)
+		for _, instalment := range liability.Instalments {
+			log.V(0).Info("instalment",
+				"year", liability.Year,
+				"period", instalment.Period,
+				"due date", instalment.DueDate.Format(time.DateOnly),
+				"tax", instalment.Tax,
+			)
+		}
+		summary.LiabilitiesData[liability.Year] = liability
+	}
+	return nil
+}
+
+// calculateFundTax works out the exit tax due per year on the fund disposals
+// in the report
+func calculateFundTax(log logr.Logger, summary *Report, parameterTable tax.ParameterTable) error {
+	disposals := []trading212.Disposal{}
+	for _, year := range getSortedYears(summary.DisposalsData) {
+		disposals = append(disposals, summary.DisposalsData[year]...)
+	}
+
+	deemedDisposals := []trading212.DeemedDisposal{}
+	for _, year := range getSortedYears(summary.DeemedDisposalsData) {
+		deemedDisposals = append(deemedDisposals, summary.DeemedDisposalsData[year]...)
+	}
+
+	fundTaxes, err := tax.CalculateFundTax(parameterTable, disposals, deemedDisposals)
+	if err != nil {
+		return merry.Errorf("failed to calculate fund tax: %w", err)
+	}
+
+	for _, fundTax := range fundTaxes {
+		log.V(0).Info("offshore funds",
+			"year", fundTax.Year,
+			"gains", fundTax.Gains,
+			"losses (not offset)", fundTax.Losses,
+			"deemed disposal tax", fundTax.DeemedDisposalTax,
+			"tax", fundTax.Tax,
+		)
+		summary.FundTaxData[fundTax.Year] = fundTax
+	}
+	return nil
+}
+
+// calculateDividendIncome totals the dividends per year and country with
+// the withholding tax that can be credited under the treaties
+func calculateDividendIncome(log logr.Logger, summary *Report, treatyRates tax.TreatyRates,
+	dividends []trading212.DividendPayment) {
+	for _, income := range tax.CalculateDividendIncome(treatyRates, dividends) {
+		log.V(0).Info("dividends",
+			"year", income.Year,
+			"gross", income.Gross,
+			"withholding tax", income.WithholdingTax,
+			"net", income.Net,
+			"tax credit", income.TaxCredit,
+			"excess withholding tax", income.ExcessWithholdingTax,
+		)
+		for _, country := range income.Countries {
+			log.V(0).Info("dividends by country",
+				"year", income.Year,
+				"country", country.Country,
+				"gross", country.Gross,
+				"withholding tax", country.WithholdingTax,
+				"net", country.Net,
+				"tax credit", country.TaxCredit,
+				"excess withholding tax", country.ExcessWithholdingTax,
+			)
+		}
+		for _, credit := range income.Credits {
+			if !credit.HasTreaty && credit.Payment.WithholdingTax.IsPositive() &&
+				credit.Payment.Country != tax.IrelandCountry {
+				log.V(0).Info("WARNING: no treaty rate for the country of the dividend, "+
+					"no credit is given for its withholding tax",
+					"id", credit.Payment.ID,
+					"ticker", credit.Payment.Ticker,
+					"country", credit.Payment.Country,
+					"withholding tax", credit.Payment.WithholdingTax,
+				)
+			}
+		}
+		summary.DividendsData[income.Year] = income
+	}
+}
+
+// calculateFundIncome works out the exit tax due per year on the fund
+// distributions
+func calculateFundIncome(log logr.Logger, summary *Report, parameterTable tax.ParameterTable,
+	distributions []trading212.DividendPayment) error {
+	fundIncomes, err := tax.CalculateFundIncome(parameterTable, distributions)
+	if err != nil {
+		return merry.Errorf("failed to calculate fund income: %w", err)
+	}
+
+	for _, fundIncome := range fundIncomes {
+		log.V(0).Info("fund distributions",
+			"year", fundIncome.Year,
+			"gross", fundIncome.Gross,
+			"withholding tax", fundIncome.WithholdingTax,
+			"net", fundIncome.Net,
+			"tax", fundIncome.Tax,
+		)
+		summary.FundIncomeData[fundIncome.Year] = fundIncome
+	}
+	return nil
+}
+
+// readHistoryFile returns the records of the history file in file order,
+// with how its columns were mapped. In lenient mode the values that could
+// not be parsed are returned instead of failing the file.
+func readHistoryFile(historyFile config.HistoryFile, lenient bool) ([]trading212.Record,
+	trading212.ColumnMapping, []trading212.CellError, error) {
 	file, err := os.Open(historyFile.Path)
 	if err != nil {
-		return trading212.StockSummary{}, trading212.StockSummary{},
-			trading212.StockSummary{}, trading212.StockSummary{},
-			merry.Errorf("failed to open file: %w", err)
+		return nil, trading212.ColumnMapping{}, nil, merry.Errorf("failed to open file: %w", err)
 	}
 	defer file.Close()
 
+	records := []trading212.Record{}
+
 	// read csv values using csv.Reader
-	csvReader := trading212.NewScanner(file)
+	csvReader, err := trading212.NewScanner(file, historyFile.Path)
+	if err != nil {
+		return nil, trading212.ColumnMapping{}, nil, merry.Errorf("failed to read file: %w", err)
+	}
+	csvReader.Lenient = lenient
 	for csvReader.Scan() {
 		record, err := csvReader.ToRecord()
 		if err != nil {
-			return trading212.StockSummary{}, trading212.StockSummary{},
-				trading212.StockSummary{}, trading212.StockSummary{},
-				merry.Errorf("failed to process file: %w", err)
+			return nil, csvReader.Mapping, csvReader.CellErrors, merry.Errorf("failed to process file: %w", err)
 		}
+		records = append(records, record)
+	}
+	err = csvReader.Err()
+	if err != nil {
+		return nil, csvReader.Mapping, csvReader.CellErrors, merry.Errorf("failed to process file: %w", err)
+	}
+	return records, csvReader.Mapping, csvReader.CellErrors, nil
+}
+
+// processRecords feeds the records to the bookkeeper in order, leaving out
+// the tickers filtered out
+// processAllRecords processes the records, then the mergers and the
+// anniversaries of the fund holdings still open up to the as of date
+func processAllRecords(log logr.Logger, bookkeeper trading212.BookKeeper, records []trading212.Record,
+	allowTickers, skipTickers []string, asOf time.Time) error {
+	err := processRecords(log, bookkeeper, records, allowTickers, skipTickers)
+	if err != nil {
+		return err
+	}
 
+	err = bookkeeper.ProcessCorporateActions(log, asOf)
+	if err != nil {
+		return merry.Errorf("failed to process corporate actions: %w", err)
+	}
+
+	err = bookkeeper.ProcessDeemedDisposals(log, asOf)
+	if err != nil {
+		return merry.Errorf("failed to process deemed disposals: %w", err)
+	}
+	return nil
+}
+
+func processRecords(log logr.Logger, bookkeeper trading212.BookKeeper, records []trading212.Record,
+	allowTickers, skipTickers []string) error {
+	for _, record := range records {
 		if len(skipTickers) > 0 && valueInList(record.Ticker, skipTickers) {
 			continue
 		}
 
 		if len(allowTickers) == 0 || valueInList(record.Ticker, allowTickers) {
-			err = bookkeeper.FindOrCreateEntryAndProcess(log, record.Ticker, record)
+			err := bookkeeper.FindOrCreateEntryAndProcess(log, record)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return bookkeeper.CheckPendingSplits()
+}
+
+// readAllSources reads the records of the history files, the opening lots
+// and the manual transactions, ordered by time across all of them. Records
+// read more than once are dropped.
+func readAllSources(log logr.Logger, summary *Report, configData config.Config) ([]trading212.Record, error) {
+	historyFiles, err := configData.GetHistoryFiles()
+	if err != nil {
+		return nil, merry.Errorf("failed to find history files: %w", err)
+	}
+
+	records := []trading212.Record{}
+	deduplicator := trading212.NewRecordDeduplicator()
+	addRecords := func(sourceRecords []trading212.Record, source string) error {
+		for _, record := range sourceRecords {
+			added, err := deduplicator.Add(record, source)
 			if err != nil {
-				return trading212.StockSummary{}, trading212.StockSummary{},
-					trading212.StockSummary{}, trading212.StockSummary{},
-					err
+				return merry.Errorf("failed to de-duplicate records: %w", err)
+			}
+			if added {
+				records = append(records, record)
 			}
 		}
+		return nil
+	}
+
+	if configData.OpeningLotsFile != "" {
+		log.V(0).Info("reading opening lots", "path", configData.OpeningLotsFile)
+
+		openingLots, err := trading212.LoadOpeningLots(configData.OpeningLotsFile)
+		if err != nil {
+			return nil, merry.Errorf("failed to load opening lots: %w", err)
+		}
+		err = addRecords(openingLots, configData.OpeningLotsFile)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	return bookkeeper.GetSaleAggregatesForYear(historyFile.Year),
-		bookkeeper.GetProfitAggregatesForYear(historyFile.Year),
-		bookkeeper.GetLossAggregatesForYear(historyFile.Year),
-		bookkeeper.GetProfitForYear(historyFile.Year),
-		nil
+	for _, historyFile := range historyFiles {
+		log.V(0).Info("reading file", "year", historyFile.Year, "path", historyFile.Path)
+
+		fileRecords, mapping, cellErrors, err := readHistoryFile(historyFile, configData.LenientParsing)
+		if err != nil {
+			return nil, merry.Errorf("failed to read file '%s': %w", historyFile.Path, err)
+		}
+		for _, cellError := range cellErrors {
+			log.Error(cellError, "value could not be parsed",
+				"path", cellError.Path,
+				"line", cellError.Line,
+				"column", cellError.Header,
+				"value", cellError.Value,
+			)
+		}
+		summary.CellErrorsData = append(summary.CellErrorsData, cellErrors...)
+		err = addRecords(fileRecords, historyFile.Path)
+		if err != nil {
+			return nil, err
+		}
+
+		fileSummary := summariseHistoryFile(historyFile, fileRecords, mapping)
+		log.V(0).Info("read file",
+			"path", historyFile.Path,
+			"years", fileSummary.Years,
+			"schema", fileSummary.Schema,
+			"extra columns", fileSummary.ExtraColumns,
+		)
+		if fileSummary.RowsOutsideYear > 0 {
+			log.V(0).Info("WARNING: file has rows outside the year it is declared for",
+				"path", historyFile.Path,
+				"declared year", historyFile.Year,
+				"years", fileSummary.Years,
+				"rows outside the year", fileSummary.RowsOutsideYear,
+			)
+		}
+		summary.HistoryFilesData = append(summary.HistoryFilesData, fileSummary)
+	}
+
+	if configData.ManualTransactionsFile != "" {
+		log.V(0).Info("reading manual transactions", "path", configData.ManualTransactionsFile)
+
+		manualTransactions, err := trading212.LoadManualTransactions(configData.ManualTransactionsFile)
+		if err != nil {
+			return nil, merry.Errorf("failed to load manual transactions: %w", err)
+		}
+
+		summary.ManualTransactionsData = manualTransactions
+		manualRecords := make([]trading212.Record, 0, len(manualTransactions))
+		for _, transaction := range manualTransactions {
+			log.V(0).Info("MANUAL transaction",
+				"id", transaction.ID,
+				"action", transaction.Action,
+				"date", transaction.Time.Format(time.DateOnly),
+				"ticker", transaction.Ticker,
+				"isin", transaction.Isin,
+				"quantity", transaction.NoOfShares,
+				"price", transaction.PriceShare,
+				"reason", transaction.Reason,
+			)
+			manualRecords = append(manualRecords, transaction.Record)
+		}
+		err = addRecords(manualRecords, configData.ManualTransactionsFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	summary.DuplicatesData = deduplicator.GetDuplicates()
+	for _, duplicate := range summary.DuplicatesData {
+		log.V(0).Info("dropped duplicate record",
+			"id", duplicate.Record.ID,
+			"action", duplicate.Record.Action,
+			"time", duplicate.Record.Time,
+			"ticker", duplicate.Record.Ticker,
+			"source", duplicate.Source,
+			"first source", duplicate.FirstSource,
+		)
+	}
+
+	trading212.SortRecords(records)
+	return records, nil
+}
+
+// getReportYears returns the years with disposals, dividends or fund
+// distributions, from the first record up to the as of date. Years with only
+// acquisitions, e.g. of opening lots, have nothing to report.
+func getReportYears(bookkeeper trading212.BookKeeper, records []trading212.Record, asOf time.Time) []int {
+	years := map[int]bool{}
+	for _, dividend := range bookkeeper.GetDividends() {
+		years[dividend.GetYear()] = true
+	}
+	for _, distribution := range bookkeeper.GetFundDistributions() {
+		years[distribution.GetYear()] = true
+	}
+
+	if len(records) > 0 {
+		// merger cash can be disposed of after the last record
+		lastYear := max(records[len(records)-1].Time.Year(), asOf.Year())
+		for year := records[0].Time.Year(); year <= lastYear; year++ {
+			if len(bookkeeper.GetDisposalsForYear(year)) > 0 {
+				years[year] = true
+			}
+		}
+	}
+	return getSortedYears(years)
+}
+
+// summariseHistoryFile returns the schema and the years of the records of the
+// file, and how many of them are outside its declared year
+func summariseHistoryFile(historyFile config.HistoryFile, records []trading212.Record,
+	mapping trading212.ColumnMapping) HistoryFileSummary {
+	fileSummary := HistoryFileSummary{
+		Path:         historyFile.Path,
+		DeclaredYear: historyFile.Year,
+		Schema:       mapping.Schema,
+		ExtraColumns: mapping.ExtraColumns,
+	}
+
+	years := map[int]bool{}
+	for _, record := range records {
+		years[record.Time.Year()] = true
+		if historyFile.Year != 0 && record.Time.Year() != historyFile.Year {
+			fileSummary.RowsOutsideYear++
+		}
+	}
+	fileSummary.Years = getSortedYears(years)
+	return fileSummary
+}
+
+func getSortedYears[T any](data map[int]T) []int {
+	years := make([]int, 0, len(data))
+	for year := range data {
+		years = append(years, year)
+	}
+	slices.Sort(years)
+	return years
 }
 
 func valueInList(value string, list []string) bool {
@@ -3,14 +3,39 @@ package pkg
 import (
 	"context"
 	"testing"
+	"time"
 
 	"github.com/go-logr/logr"
 	"github.com/shopspring/decimal"
 	"github.com/stretchr/testify/assert"
 	"trading212-parser.kimi450.com/pkg/config"
+	"trading212-parser.kimi450.com/pkg/tax"
 	"trading212-parser.kimi450.com/pkg/trading212"
 )
 
+// testAsOf is the date the tests are run as of, so the deemed disposals do
+// not depend on the day they are run
+var testAsOf = time.Date(2026, 6, 30, 0, 0, 0, 0, time.UTC)
+
+// processTestHistoryFile reads the history file and processes its records
+// as processAllHistoryFiles does, returning the sale, profit and loss
+// aggregates and the profits of the year of the file
+func processTestHistoryFile(log logr.Logger, bookkeeper trading212.BookKeeper,
+	historyFile config.HistoryFile) (trading212.StockSummary, trading212.StockSummary,
+	trading212.StockSummary, trading212.StockSummary, error) {
+	configData := config.Config{HistoryFiles: []config.HistoryFile{historyFile}}
+
+	records, err := readAllSources(log, &Report{}, configData)
+	if err == nil {
+		err = processAllRecords(log, bookkeeper, records, []string{}, []string{}, testAsOf)
+	}
+	return bookkeeper.GetSaleAggregatesForYear(historyFile.Year),
+		bookkeeper.GetProfitAggregatesForYear(historyFile.Year),
+		bookkeeper.GetLossAggregatesForYear(historyFile.Year),
+		bookkeeper.GetProfitForYear(historyFile.Year),
+		err
+}
+
 func TestProcessHistoryFileLIFO(t *testing.T) {
 	log := logr.FromContextOrDiscard(context.TODO())
 
@@ -20,7 +45,7 @@ func TestProcessHistoryFileLIFO(t *testing.T) {
 		Year: 2024,
 		Path: "../test-data/testdata-lifo-only.csv",
 	}
-	saleAggregates, profitAggregates, lossAggregates, profits, err := processHistoryFile(log, bookkeeper, historyFile, []string{}, []string{})
+	saleAggregates, profitAggregates, lossAggregates, profits, err := processTestHistoryFile(log, bookkeeper, historyFile)
 
 	assert.NoError(t, err)
 	t.Log(profits.Overall)
@@ -31,6 +56,79 @@ func TestProcessHistoryFileLIFO(t *testing.T) {
 
 }
 
+func TestProcessHistoryFileLIFOWindow(t *testing.T) {
+	log := logr.FromContextOrDiscard(context.TODO())
+
+	bookkeeper := trading212.NewBookkeeper()
+
+	historyFile := config.HistoryFile{
+		Year: 2024,
+		Path: "../test-data/testdata-lifo-window.csv",
+	}
+	saleAggregates, profitAggregates, lossAggregates, profits, err := processTestHistoryFile(log, bookkeeper, historyFile)
+
+	assert.NoError(t, err)
+	assertEqualDecimals(t, decimal.NewFromInt(55), profits.Overall)
+	assertEqualDecimals(t, decimal.NewFromInt(108), saleAggregates.Overall)
+	assertEqualDecimals(t, decimal.NewFromInt(0), lossAggregates.Overall)
+	assertEqualDecimals(t, decimal.NewFromInt(55), profitAggregates.Overall)
+
+	disposals := bookkeeper.GetDisposalsForYear(2024)
+	assert.Len(t, disposals, 3)
+
+	// every acquisition in the 4 week window newest first, then FIFO
+	assert.Len(t, disposals[0].Lots, 3)
+	assert.Equal(t, "TESTID_3", disposals[0].Lots[0].BuyID)
+	assert.Equal(t, trading212.LIFO, disposals[0].Lots[0].Method)
+	assert.Equal(t, "TESTID_2", disposals[0].Lots[1].BuyID)
+	assert.Equal(t, trading212.LIFO, disposals[0].Lots[1].Method)
+	assert.Equal(t, "TESTID_1", disposals[0].Lots[2].BuyID)
+	assert.Equal(t, trading212.FIFO, disposals[0].Lots[2].Method)
+	assertEqualDecimals(t, decimal.NewFromInt(2), disposals[0].Lots[2].Quantity)
+
+	// a partially consumed recent lot is still identified first
+	assert.Len(t, disposals[2].Lots, 2)
+	assert.Equal(t, "TESTID_5", disposals[2].Lots[0].BuyID)
+	assert.Equal(t, trading212.LIFO, disposals[2].Lots[0].Method)
+	assertEqualDecimals(t, decimal.NewFromInt(2), disposals[2].Lots[0].Quantity)
+	assert.Equal(t, "TESTID_1", disposals[2].Lots[1].BuyID)
+	assert.Equal(t, trading212.FIFO, disposals[2].Lots[1].Method)
+	assertEqualDecimals(t, decimal.NewFromInt(6), disposals[2].Lots[1].Quantity)
+}
+
+func TestProcessHistoryFileDisposals(t *testing.T) {
+	log := logr.FromContextOrDiscard(context.TODO())
+
+	bookkeeper := trading212.NewBookkeeper()
+
+	historyFile := config.HistoryFile{
+		Year: 2024,
+		Path: "../test-data/testdata-lifo-only.csv",
+	}
+	_, _, _, _, err := processTestHistoryFile(log, bookkeeper, historyFile)
+	assert.NoError(t, err)
+
+	disposals := bookkeeper.GetDisposalsForYear(2024)
+	assert.Len(t, disposals, 2)
+
+	// sold within 4 weeks of both buys, newest lot first
+	assert.Len(t, disposals[0].Lots, 2)
+	assert.Equal(t, trading212.LIFO, disposals[0].Lots[0].Method)
+	assertEqualDecimals(t, decimal.NewFromInt(5), disposals[0].Lots[0].Quantity)
+	assertEqualDecimals(t, decimal.NewFromInt(10), disposals[0].Lots[0].Cost)
+	assertEqualDecimals(t, decimal.NewFromInt(10), disposals[0].Lots[0].Proceeds)
+	assert.Equal(t, trading212.LIFO, disposals[0].Lots[1].Method)
+	assertEqualDecimals(t, decimal.NewFromInt(3), disposals[0].Lots[1].Quantity)
+	assertEqualDecimals(t, decimal.NewFromInt(3), disposals[0].Lots[1].Cost)
+	assertEqualDecimals(t, decimal.NewFromInt(3), disposals[0].Profit)
+
+	assert.Len(t, disposals[1].Lots, 1)
+	assert.Equal(t, trading212.FIFO, disposals[1].Lots[0].Method)
+	assertEqualDecimals(t, decimal.NewFromInt(4), disposals[1].Lots[0].Cost)
+	assertEqualDecimals(t, decimal.NewFromInt(40), disposals[1].Lots[0].Proceeds)
+	assertEqualDecimals(t, decimal.NewFromInt(36), disposals[1].Profit)
+}
+
 func TestProcessHistoryFileFIFO(t *testing.T) {
 	log := logr.FromContextOrDiscard(context.TODO())
 
@@ -40,7 +138,7 @@ func TestProcessHistoryFileFIFO(t *testing.T) {
 		Year: 2024,
 		Path: "../test-data/testdata-fifo-only.csv",
 	}
-	saleAggregates, profitAggregates, lossAggregates, profits, err := processHistoryFile(log, bookkeeper, historyFile, []string{}, []string{})
+	saleAggregates, profitAggregates, lossAggregates, profits, err := processTestHistoryFile(log, bookkeeper, historyFile)
 
 	assert.NoError(t, err)
 	t.Log(profits.Overall)
@@ -60,7 +158,7 @@ func TestProcessHistoryFileCurrency(t *testing.T) {
 		Year: 2024,
 		Path: "../test-data/testdata-currency.csv",
 	}
-	saleAggregates, profitAggregates, lossAggregates, profits, err := processHistoryFile(log, bookkeeper, historyFile, []string{}, []string{})
+	saleAggregates, profitAggregates, lossAggregates, profits, err := processTestHistoryFile(log, bookkeeper, historyFile)
 
 	assert.NoError(t, err)
 	assertEqualDecimals(t, decimal.NewFromFloat(24.07), profits.Overall)
@@ -79,7 +177,7 @@ func TestProcessHistoryFileCurrencyOverride(t *testing.T) {
 		Year: 2024,
 		Path: "../test-data/testdata-currency-override.csv",
 	}
-	saleAggregates, profitAggregates, lossAggregates, profits, err := processHistoryFile(log, bookkeeper, historyFile, []string{}, []string{})
+	saleAggregates, profitAggregates, lossAggregates, profits, err := processTestHistoryFile(log, bookkeeper, historyFile)
 
 	assert.NoError(t, err)
 	assertEqualDecimals(t, decimal.NewFromFloat(22.7), profits.Overall)
@@ -133,7 +231,7 @@ func TestProcessAllHistoryFiles(t *testing.T) {
 		2025: decimal.NewFromInt(131),
 	}
 
-	summary := processAllHistoryFiles(log, []string{}, []string{}, configData)
+	summary := processAllHistoryFiles(log, []string{}, []string{}, configData, testAsOf)
 
 	for _, historyFile := range configData.HistoryFiles {
 		actualProfitValue := summary.ProfitsData[historyFile.Year].Overall
@@ -172,28 +270,1399 @@ func TestProcessAllHistoryFiles(t *testing.T) {
 			"actual", expectedProfitAggregateValue)
 		assertEqualDecimals(t, expectedProfitAggregateValue, actualProfitAggregateValue)
 	}
+
+	// the 2022 loss is carried into 2023
+	assertEqualDecimals(t, decimal.NewFromInt(30), summary.LiabilitiesData[2022].LossesCarriedForward)
+	assertEqualDecimals(t, decimal.NewFromInt(30), summary.LiabilitiesData[2023].LossesBroughtForwardUsed)
+	assertEqualDecimals(t, decimal.NewFromInt(0), summary.LiabilitiesData[2023].Tax)
+}
+
+func TestProcessHistoryFileStockSplit(t *testing.T) {
+	log := logr.FromContextOrDiscard(context.TODO())
+
+	bookkeeper := trading212.NewBookkeeper()
+
+	historyFile := config.HistoryFile{
+		Year: 2024,
+		Path: "../test-data/testdata-stock-split.csv",
+	}
+	_, _, _, profits, err := processTestHistoryFile(log, bookkeeper, historyFile)
+	assert.NoError(t, err)
+
+	// 20 * 70 - 1000, the first lot is 20 shares at 50 after the 1:2 split
+	assertEqualDecimals(t, decimal.NewFromInt(400), profits.Overall)
+
+	disposals := bookkeeper.GetDisposalsForYear(2024)
+	assert.Len(t, disposals, 1)
+	assert.Len(t, disposals[0].Lots, 1)
+	assert.Equal(t, "2024-01-10", disposals[0].Lots[0].BuyDate.Format(time.DateOnly))
+	assertEqualDecimals(t, decimal.NewFromInt(20), disposals[0].Lots[0].Quantity)
+	assertEqualDecimals(t, decimal.NewFromInt(1000), disposals[0].Lots[0].Cost)
+}
+
+func TestProcessHistoryFileStockSplitConflict(t *testing.T) {
+	log := logr.FromContextOrDiscard(context.TODO())
+
+	corporateActions, err := trading212.LoadCorporateActions("../test-data/testdata-stock-split-conflict.json")
+	assert.NoError(t, err)
+	bookkeeper := trading212.NewBookkeeperFromReferenceData(trading212.ReferenceData{
+		CorporateActions: corporateActions,
+	})
+
+	historyFile := config.HistoryFile{
+		Year: 2024,
+		Path: "../test-data/testdata-stock-split.csv",
+	}
+	_, _, _, _, err = processTestHistoryFile(log, bookkeeper, historyFile)
+	assert.ErrorContains(t, err, "applied twice")
+}
+
+func TestProcessHistoryFileStockSplitBuiltIn(t *testing.T) {
+	log := logr.FromContextOrDiscard(context.TODO())
+
+	historyFile := config.HistoryFile{
+		Year: 2024,
+		Path: "../test-data/testdata-stock-split-builtin.csv",
+	}
+
+	// the 2024 NVDA split is built in, the export can only be used once it
+	// is turned off
+	_, _, _, _, err := processTestHistoryFile(log, trading212.NewBookkeeper(), historyFile)
+	assert.ErrorContains(t, err, `"Disabled": true} in the corporate actions file`)
+
+	corporateActions, err := trading212.LoadCorporateActions("../test-data/testdata-stock-split-builtin.json")
+	assert.NoError(t, err)
+	bookkeeper := trading212.NewBookkeeperFromReferenceData(trading212.ReferenceData{
+		CorporateActions: corporateActions,
+	})
+	_, _, _, profits, err := processTestHistoryFile(log, bookkeeper, historyFile)
+	assert.NoError(t, err)
+	// 50 * 120 - 50 * 100, the 10 shares at 1000 are 100 at 100 after the
+	// split rows
+	assertEqualDecimals(t, decimal.NewFromInt(1000), profits.Overall)
+
+	// only the built in actions can be turned off
+	_, err = trading212.LoadCorporateActions("../test-data/testdata-stock-split-disabled.json")
+	assert.ErrorContains(t, err, "disabled forward-split of 'KIMI450' on 2024-03-02 is not a built in corporate action")
+}
+
+func TestProcessHistoryFileStockSplitUnpaired(t *testing.T) {
+	log := logr.FromContextOrDiscard(context.TODO())
+
+	bookkeeper := trading212.NewBookkeeper()
+
+	historyFile := config.HistoryFile{
+		Year: 2024,
+		Path: "../test-data/testdata-stock-split-unpaired.csv",
+	}
+	_, _, _, _, err := processTestHistoryFile(log, bookkeeper, historyFile)
+	assert.ErrorContains(t, err, "stock split row 'TESTID_3' for 'KIMI450' on 2024-03-01 has no matching Stock split open row")
+}
+
+func TestProcessHistoryFileStockSplitMismatch(t *testing.T) {
+	log := logr.FromContextOrDiscard(context.TODO())
+
+	bookkeeper := trading212.NewBookkeeper()
+
+	// only the first lot of 10 shares is held, the split closes 15
+	historyFile := config.HistoryFile{
+		Year: 2024,
+		Path: "../test-data/testdata-stock-split-mismatch.csv",
+	}
+	_, _, _, _, err := processTestHistoryFile(log, bookkeeper, historyFile)
+	assert.ErrorContains(t, err, "closes 15 shares of 'KIMI450' but 10 are held")
+
+	// the lot is not rescaled
+	queue := bookkeeper.(*trading212.BookKeeperStruct).Get("KIMI450").GetRecordQueue().GetQueue()
+	assert.Len(t, queue, 1)
+	assertEqualDecimals(t, decimal.NewFromInt(10), queue[0].NoOfShares)
+}
+
+func TestProcessHistoryFileTickerChange(t *testing.T) {
+	log := logr.FromContextOrDiscard(context.TODO())
+
+	corporateActions, err := trading212.LoadCorporateActions("../test-data/testdata-ticker-change.json")
+	assert.NoError(t, err)
+	bookkeeper := trading212.NewBookkeeperFromReferenceData(trading212.ReferenceData{
+		CorporateActions: corporateActions,
+	})
+
+	historyFile := config.HistoryFile{
+		Year: 2024,
+		Path: "../test-data/testdata-ticker-change.csv",
+	}
+	_, _, _, profits, err := processTestHistoryFile(log, bookkeeper, historyFile)
+	assert.NoError(t, err)
+
+	// 4500 - 3000 for FB sold as META, 300 - (100 + 120) for
+	// KIMI450 across the ISIN change
+	assertEqualDecimals(t, decimal.NewFromInt(1580), profits.Overall)
+
+	instruments := bookkeeper.GetInstruments()
+	assert.Len(t, instruments, 2)
+	assert.Equal(t, "US30303M1027", instruments[0].Key)
+	assert.Equal(t, "FB", instruments[0].Aliases[0].Ticker)
+	assert.Equal(t, "META", instruments[0].Aliases[1].Ticker)
+	// the shares bought before the ISIN change are restated to the new ISIN
+	assert.Equal(t, "XX0000000002", instruments[1].Key)
+	assert.Empty(t, bookkeeper.GetTickerCollisions())
+}
+
+func TestProcessHistoryFileTickerCollision(t *testing.T) {
+	log := logr.FromContextOrDiscard(context.TODO())
+
+	bookkeeper := trading212.NewBookkeeper()
+
+	// without the isin-change the new ISIN is a different instrument, so
+	// the sale of 20 shares only has the 10 bought under it
+	historyFile := config.HistoryFile{
+		Year: 2024,
+		Path: "../test-data/testdata-ticker-change.csv",
+	}
+	_, _, _, _, err := processTestHistoryFile(log, bookkeeper, historyFile)
+	assert.ErrorContains(t, err, "not enough shares available to sell")
+
+	assert.Equal(t, []trading212.TickerCollision{
+		{
+			ID:       "TESTID_4",
+			Date:     time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC),
+			Ticker:   "KIMI450",
+			Isin:     "XX0000000002",
+			HeldIsin: "XX0000000001",
+		},
+	}, bookkeeper.GetTickerCollisions())
+}
+
+func TestProcessAllHistoryFilesTickerOnly(t *testing.T) {
+	log := logr.FromContextOrDiscard(context.TODO())
+
+	configData := config.Config{
+		HistoryFiles: []config.HistoryFile{
+			{
+				Year: 2024,
+				Path: "../test-data/testdata-ticker-only.csv",
+			},
+		},
+	}
+
+	summary := processAllHistoryFiles(log, []string{}, []string{}, configData, testAsOf)
+
+	// the shares bought without an ISIN are sold by the row with one, it is
+	// not a collision as they were never held under another ISIN
+	disposals := summary.DisposalsData[2024]
+	assert.Len(t, disposals, 1)
+	assert.Equal(t, "TESTID_1", disposals[0].Lots[0].BuyID)
+	assertEqualDecimals(t, decimal.NewFromInt(100), summary.ProfitsData[2024].Overall)
+	assert.Empty(t, summary.TickerCollisionsData)
+	assert.Len(t, summary.InstrumentsData, 1)
+	assert.Equal(t, "KIMI450", summary.InstrumentsData[0].Key)
+}
+
+func TestProcessAllHistoryFilesPaymentPeriods(t *testing.T) {
+	log := logr.FromContextOrDiscard(context.TODO())
+
+	configData := config.Config{
+		HistoryFiles: []config.HistoryFile{
+			{
+				Year: 2024,
+				Path: "../test-data/testdata-payment-periods.csv",
+			},
+		},
+	}
+
+	summary := processAllHistoryFiles(log, []string{}, []string{}, configData, testAsOf)
+
+	initialPeriod := summary.PeriodSummariesData[2024][trading212.InitialPeriod]
+	laterPeriod := summary.PeriodSummariesData[2024][trading212.LaterPeriod]
+	assertEqualDecimals(t, decimal.NewFromInt(2000), initialPeriod.Profits.Overall)
+	assertEqualDecimals(t, decimal.NewFromInt(2500), initialPeriod.SaleAggregates.Overall)
+	assertEqualDecimals(t, decimal.NewFromInt(1000), laterPeriod.Profits.Overall)
+	assertEqualDecimals(t, decimal.NewFromInt(1500), laterPeriod.SaleAggregates.Overall)
+	assertEqualDecimals(t, decimal.NewFromInt(3000), summary.ProfitsData[2024].Overall)
+
+	// (2000 - 1270) * 0.33 by 15 December, the rest of (3000 - 1270) * 0.33
+	// by 31 January
+	liability := summary.LiabilitiesData[2024]
+	assertEqualDecimals(t, decimal.NewFromFloat(570.9), liability.Tax)
+	assert.Len(t, liability.Instalments, 2)
+	assert.Equal(t, trading212.InitialPeriod, liability.Instalments[0].Period)
+	assert.Equal(t, "2024-12-15", liability.Instalments[0].DueDate.Format(time.DateOnly))
+	assertEqualDecimals(t, decimal.NewFromFloat(240.9), liability.Instalments[0].Tax)
+	assert.Equal(t, trading212.LaterPeriod, liability.Instalments[1].Period)
+	assert.Equal(t, "2025-01-31", liability.Instalments[1].DueDate.Format(time.DateOnly))
+	assertEqualDecimals(t, decimal.NewFromInt(330), liability.Instalments[1].Tax)
+}
+
+func TestProcessAllHistoryFilesFunds(t *testing.T) {
+	log := logr.FromContextOrDiscard(context.TODO())
+
+	configData := config.Config{
+		HistoryFiles: []config.HistoryFile{
+			{
+				Year: 2024,
+				Path: "../test-data/testdata-funds.csv",
+			},
+		},
+	}
+
+	summary := processAllHistoryFiles(log, []string{}, []string{}, configData, testAsOf)
+
+	// the fund loss is not offset against the fund gain or the share gain
+	fundTax := summary.FundTaxData[2024]
+	assertEqualDecimals(t, decimal.NewFromInt(100), fundTax.Gains)
+	assertEqualDecimals(t, decimal.NewFromInt(-100), fundTax.Losses)
+	assertEqualDecimals(t, decimal.NewFromInt(41), fundTax.Tax)
+	assert.Len(t, fundTax.Disposals, 2)
+
+	// (2000 - 1270) * 0.33
+	liability := summary.LiabilitiesData[2024]
+	assertEqualDecimals(t, decimal.NewFromInt(2000), liability.Gains)
+	assertEqualDecimals(t, decimal.NewFromInt(0), liability.CurrentYearLossesUsed)
+	assertEqualDecimals(t, decimal.NewFromFloat(240.9), liability.Tax)
+}
+
+func TestProcessAllHistoryFilesClassification(t *testing.T) {
+	log := logr.FromContextOrDiscard(context.TODO())
+
+	configData := config.Config{
+		HistoryFiles: []config.HistoryFile{
+			{
+				Year: 2024,
+				Path: "../test-data/testdata-classification.csv",
+			},
+		},
+		ClassificationFile: "../test-data/testdata-classifications.json",
+	}
+
+	summary := processAllHistoryFiles(log, []string{}, []string{}, configData, testAsOf)
+
+	// EQQQ is in the registry, IWDA is treated as a fund pending review
+	fundTax := summary.FundTaxData[2024]
+	assert.Len(t, fundTax.Disposals, 2)
+	assertEqualDecimals(t, decimal.NewFromInt(200), fundTax.Gains)
+	assertEqualDecimals(t, decimal.NewFromInt(82), fundTax.Tax)
+
+	// the unknown stock is still processed as a stock
+	assertEqualDecimals(t, decimal.NewFromInt(2000), summary.LiabilitiesData[2024].Gains)
+
+	assert.Equal(t, []trading212.UnclassifiedInstrument{
+		{
+			Isin:   "IE00B4L5Y983",
+			Ticker: "IWDA",
+			Name:   "iShares Core MSCI World UCITS ETF",
+			Class:  trading212.UCITSFundClass,
+			Status: trading212.NeedsReview,
+		},
+		{
+			Isin:   "US0000000001",
+			Ticker: "KIMI450",
+			Name:   "Test stock",
+			Class:  trading212.StockClass,
+			Status: trading212.Unknown,
+		},
+	}, summary.UnclassifiedInstruments)
+}
+
+func TestProcessAllHistoryFilesClassificationReview(t *testing.T) {
+	log := logr.FromContextOrDiscard(context.TODO())
+
+	configData := config.Config{
+		HistoryFiles: []config.HistoryFile{
+			{
+				Year: 2024,
+				Path: "../test-data/testdata-classification-review.csv",
+			},
+		},
+		ClassificationFile: "../test-data/testdata-classifications-review.json",
+	}
+
+	summary := processAllHistoryFiles(log, []string{}, []string{}, configData, testAsOf)
+
+	// the US ETF and the ETC are processed under CGT, but are listed for
+	// review even though the ETC is in the registry
+	assert.Empty(t, summary.FundTaxData[2024].Disposals)
+	assertEqualDecimals(t, decimal.NewFromInt(600), summary.LiabilitiesData[2024].Gains)
+	assert.Equal(t, []trading212.UnclassifiedInstrument{
+		{
+			Isin:   "JE00B1VS3770",
+			Ticker: "PHAU",
+			Name:   "WisdomTree Physical Gold",
+			Class:  trading212.ETCClass,
+			Status: trading212.NeedsReview,
+		},
+		{
+			Isin:   "US78462F1030",
+			Ticker: "SPY",
+			Name:   "SPDR S&P 500 ETF Trust",
+			Class:  trading212.USETFClass,
+			Status: trading212.NeedsReview,
+		},
+	}, summary.UnclassifiedInstruments)
+}
+
+func TestProcessAllHistoryFilesCorporateActions(t *testing.T) {
+	log := logr.FromContextOrDiscard(context.TODO())
+
+	configData := config.Config{
+		HistoryFiles: []config.HistoryFile{
+			{
+				Year: 2024,
+				Path: "../test-data/testdata-corporate-actions.csv",
+			},
+		},
+		CorporateActionsFile: "../test-data/testdata-corporate-actions.json",
+	}
+
+	summary := processAllHistoryFiles(log, []string{}, []string{}, configData, testAsOf)
+
+	// 20 * 60 - 1000 after the 1:2 split, and 1500 - 1000 after the ticker
+	// change and the 10:1 reverse split
+	assertEqualDecimals(t, decimal.NewFromInt(700), summary.ProfitsData[2024].Overall)
+
+	disposals := summary.DisposalsData[2024]
+	assert.Len(t, disposals, 2)
+	assert.Equal(t, "KIMI452", disposals[1].Ticker)
+	assertEqualDecimals(t, decimal.NewFromInt(1), disposals[1].Lots[0].Quantity)
+
+	applied := summary.CorporateActionsData
+	assert.Len(t, applied, 3)
+	assert.Equal(t, trading212.ForwardSplit, applied[0].Action.Type)
+	assert.Equal(t, "TESTID_1", applied[0].RecordID)
+	assertEqualDecimals(t, decimal.NewFromInt(20), applied[0].QuantityAfter)
+	assert.Equal(t, trading212.TickerChange, applied[1].Action.Type)
+	assert.Equal(t, trading212.ReverseSplit, applied[2].Action.Type)
+	assert.Equal(t, "KIMI452", applied[2].Ticker)
+	assertEqualDecimals(t, decimal.NewFromInt(1), applied[2].QuantityAfter)
+}
+
+func TestProcessAllHistoryFilesMerger(t *testing.T) {
+	log := logr.FromContextOrDiscard(context.TODO())
+
+	configData := config.Config{
+		HistoryFiles: []config.HistoryFile{
+			{
+				Year: 2024,
+				Path: "../test-data/testdata-merger.csv",
+			},
+		},
+		CorporateActionsFile: "../test-data/testdata-merger.json",
+	}
+
+	summary := processAllHistoryFiles(log, []string{}, []string{}, configData, testAsOf)
+
+	// the takeover rows of the export are skipped, only the mergers in the
+	// corporate actions move the shares and the cash
+	disposals := summary.DisposalsData[2024]
+	assert.Len(t, disposals, 3)
+
+	// the cash is 30 of the 30 + 2 * 60 received per share, so it takes a
+	// fifth of the cost
+	assert.Equal(t, "KIMI450", disposals[0].Ticker)
+	assert.Equal(t, trading212.CorporateActionMatch, disposals[0].Lots[0].Method)
+	assertEqualDecimals(t, decimal.NewFromInt(300), disposals[0].Proceeds)
+	assertEqualDecimals(t, decimal.NewFromInt(200), disposals[0].Cost)
+
+	// cash only, all of the cost is disposed of
+	assert.Equal(t, "KIMI451", disposals[1].Ticker)
+	assertEqualDecimals(t, decimal.NewFromInt(100), disposals[1].Profit)
+
+	// the new shares keep the acquisition date and the rest of the cost
+	assert.Equal(t, "KIMI452", disposals[2].Ticker)
+	assert.Equal(t, "2024-01-10", disposals[2].Lots[0].BuyDate.Format(time.DateOnly))
+	assertEqualDecimals(t, decimal.NewFromInt(200), disposals[2].Cost)
+	assertEqualDecimals(t, decimal.NewFromInt(150), disposals[2].Profit)
+
+	assertEqualDecimals(t, decimal.NewFromInt(350), summary.ProfitsData[2024].Overall)
+
+	applied := summary.CorporateActionsData
+	assert.Len(t, applied, 2)
+	assertEqualDecimals(t, decimal.NewFromInt(20), applied[0].QuantityAfter)
+	assertEqualDecimals(t, decimal.NewFromInt(0), applied[1].QuantityAfter)
+
+	// the rows add no lots, cash or instruments of their own
+	assert.Empty(t, summary.DividendsData)
+	assert.Len(t, summary.InstrumentsData, 3)
+}
+
+func TestProcessAllHistoryFilesSpinOff(t *testing.T) {
+	log := logr.FromContextOrDiscard(context.TODO())
+
+	configData := config.Config{
+		HistoryFiles: []config.HistoryFile{
+			{
+				Year: 2024,
+				Path: "../test-data/testdata-spin-off.csv",
+			},
+		},
+		CorporateActionsFile: "../test-data/testdata-spin-off.json",
+	}
+
+	summary := processAllHistoryFiles(log, []string{}, []string{}, configData, testAsOf)
+
+	disposals := summary.DisposalsData[2024]
+	assert.Len(t, disposals, 2)
+
+	// the shares spun off take a fifth of the cost and the parent acquisition
+	// date
+	assert.Equal(t, "KIMI453", disposals[0].Ticker)
+	assert.Equal(t, "2023-05-10", disposals[0].Lots[0].BuyDate.Format(time.DateOnly))
+	assert.Equal(t, trading212.FIFO, disposals[0].Lots[0].Method)
+	assertEqualDecimals(t, decimal.NewFromInt(200), disposals[0].Cost)
+
+	assert.Equal(t, "KIMI450", disposals[1].Ticker)
+	assertEqualDecimals(t, decimal.NewFromInt(800), disposals[1].Cost)
+
+	assertEqualDecimals(t, decimal.NewFromInt(200), summary.ProfitsData[2024].Overall)
+}
+
+func TestProcessAllHistoryFilesCostAdjustments(t *testing.T) {
+	log := logr.FromContextOrDiscard(context.TODO())
+
+	configData := config.Config{
+		HistoryFiles: []config.HistoryFile{
+			{
+				Year: 2024,
+				Path: "../test-data/testdata-return-of-capital.csv",
+			},
+		},
+		AdjustmentsFile: "../test-data/testdata-adjustments.json",
+	}
+
+	summary := processAllHistoryFiles(log, []string{}, []string{}, configData, testAsOf)
+
+	adjustments := summary.CostAdjustmentsData
+	assert.Len(t, adjustments, 2)
+	assert.Equal(t, trading212.ExportSource, adjustments[0].Source)
+	assertEqualDecimals(t, decimal.NewFromInt(200), adjustments[0].CostReduction)
+	assertEqualDecimals(t, decimal.NewFromInt(0), adjustments[0].ExcessGain)
+	assert.Equal(t, trading212.ManualSource, adjustments[1].Source)
+	assertEqualDecimals(t, decimal.NewFromInt(100), adjustments[1].CostReduction)
+	assertEqualDecimals(t, decimal.NewFromInt(50), adjustments[1].ExcessGain)
+
+	// 50 above the cost of KIMI451, and 900 - (1000 - 200) for KIMI450
+	disposals := summary.DisposalsData[2024]
+	assert.Len(t, disposals, 2)
+	assertEqualDecimals(t, decimal.NewFromInt(50), disposals[0].Profit)
+	assertEqualDecimals(t, decimal.NewFromInt(800), disposals[1].Cost)
+	assertEqualDecimals(t, decimal.NewFromInt(150), summary.ProfitsData[2024].Overall)
 }
 
-// func TestProcessHistoryFileWashSaleEasy(t *testing.T) {
-// 	log := logr.FromContextOrDiscard(context.TODO())
+func TestProcessAllHistoryFilesOpeningLots(t *testing.T) {
+	log := logr.FromContextOrDiscard(context.TODO())
+
+	configData := config.Config{
+		HistoryFiles: []config.HistoryFile{
+			{
+				Year: 2024,
+				Path: "../test-data/testdata-opening-lots.csv",
+			},
+		},
+		OpeningLotsFile: "../test-data/testdata-opening-lots.json",
+	}
+
+	summary := processAllHistoryFiles(log, []string{}, []string{}, configData, testAsOf)
+
+	// the opening lot is matched first, then 5 of the shares bought
+	disposals := summary.DisposalsData[2024]
+	assert.Len(t, disposals, 1)
+	assert.Len(t, disposals[0].Lots, 2)
+	assert.Equal(t, "opening-lot-1", disposals[0].Lots[0].BuyID)
+	assert.Equal(t, trading212.FIFO, disposals[0].Lots[0].Method)
+	assertEqualDecimals(t, decimal.NewFromInt(500), disposals[0].Lots[0].Cost)
+	assertEqualDecimals(t, decimal.NewFromInt(500), disposals[0].Lots[1].Cost)
+	assertEqualDecimals(t, decimal.NewFromInt(800), summary.ProfitsData[2024].Overall)
 
-// 	bookkeeper := trading212.NewBookkeeper()
+	// the opening lot was acquired in 2023, there is nothing to report for it
+	assert.Equal(t, []int{2024}, summary.Years)
+}
 
-// 	historyFile := config.HistoryFile{
-// 		Year: 2024,
-// 		Path: "../test-data/testdata-wash-sale.csv",
-// 	}
-// 	saleAggregates, profitAggregates, lossAggregates, profits, err := processHistoryFile(log, bookkeeper, historyFile, []string{}, []string{})
+func TestProcessAllHistoryFilesOpeningLotsIsin(t *testing.T) {
+	log := logr.FromContextOrDiscard(context.TODO())
 
-// 	assert.NoError(t, err)
-// 	t.Log(profits.Overall)
+	// the rows of an export carry an ISIN, the opening lot only a ticker
+	configData := config.Config{
+		HistoryFiles: []config.HistoryFile{
+			{
+				Year: 2024,
+				Path: "../test-data/testdata-opening-lots-isin.csv",
+			},
+		},
+		OpeningLotsFile: "../test-data/testdata-opening-lots.json",
+	}
 
-// 	assertEqualDecimals(t, decimal.NewFromInt(100), profits.Overall)
-// 	assertEqualDecimals(t, decimal.NewFromInt(1540), saleAggregates.Overall)
-// 	assertEqualDecimals(t, decimal.NewFromInt(-100), lossAggregates.Overall)
-// 	assertEqualDecimals(t, decimal.NewFromInt(-100), profitAggregates.Overall)
+	summary := processAllHistoryFiles(log, []string{}, []string{}, configData, testAsOf)
 
-// }
+	disposals := summary.DisposalsData[2024]
+	assert.Len(t, disposals, 1)
+	assert.Len(t, disposals[0].Lots, 2)
+	assert.Equal(t, "opening-lot-1", disposals[0].Lots[0].BuyID)
+	assert.Equal(t, "TESTID_1", disposals[0].Lots[1].BuyID)
+	assertEqualDecimals(t, decimal.NewFromInt(800), summary.ProfitsData[2024].Overall)
+	assert.Empty(t, summary.TickerCollisionsData)
+}
+
+func TestProcessAllHistoryFilesManualTransactions(t *testing.T) {
+	log := logr.FromContextOrDiscard(context.TODO())
+
+	configData := config.Config{
+		HistoryFiles: []config.HistoryFile{
+			{
+				Year: 2024,
+				Path: "../test-data/testdata-manual-transactions.csv",
+			},
+		},
+		ManualTransactionsFile: "../test-data/testdata-manual-transactions.json",
+	}
+
+	summary := processAllHistoryFiles(log, []string{}, []string{}, configData, testAsOf)
+
+	assert.Len(t, summary.ManualTransactionsData, 2)
+	assert.Equal(t, "manual-2", summary.ManualTransactionsData[0].ID)
+
+	// the inherited shares are bought before the sale, and the gift is a
+	// disposal of the rest of them
+	disposals := summary.DisposalsData[2024]
+	assert.Len(t, disposals, 2)
+	assert.Empty(t, disposals[0].ManualReason)
+	assert.Empty(t, disposals[0].Lots[0].ManualReason)
+	assert.Equal(t, "inherited, market value on the date of death", disposals[0].Lots[1].ManualReason)
+	assertEqualDecimals(t, decimal.NewFromInt(250), disposals[0].Profit)
+	assert.Equal(t, "gift to a family member, deemed disposal at market value", disposals[1].ManualReason)
+	assertEqualDecimals(t, decimal.NewFromInt(100), disposals[1].Profit)
+}
+
+func TestProcessAllHistoryFilesManualTransactionsIsin(t *testing.T) {
+	log := logr.FromContextOrDiscard(context.TODO())
+
+	// the rows of an export carry an ISIN, the manual transactions only a
+	// ticker, they are all of the same instrument
+	configData := config.Config{
+		HistoryFiles: []config.HistoryFile{
+			{
+				Year: 2024,
+				Path: "../test-data/testdata-manual-transactions-isin.csv",
+			},
+		},
+		ManualTransactionsFile: "../test-data/testdata-manual-transactions.json",
+	}
+
+	summary := processAllHistoryFiles(log, []string{}, []string{}, configData, testAsOf)
+
+	disposals := summary.DisposalsData[2024]
+	assert.Len(t, disposals, 2)
+	assert.Equal(t, "TESTID_1", disposals[0].Lots[0].BuyID)
+	assert.Equal(t, "manual-2", disposals[0].Lots[1].BuyID)
+	assertEqualDecimals(t, decimal.NewFromInt(250), disposals[0].Profit)
+	assert.Equal(t, "gift to a family member, deemed disposal at market value", disposals[1].ManualReason)
+	assertEqualDecimals(t, decimal.NewFromInt(100), disposals[1].Profit)
+	assert.Empty(t, summary.TickerCollisionsData)
+	assert.Len(t, summary.InstrumentsData, 1)
+}
+
+func TestProcessAllHistoryFilesUnordered(t *testing.T) {
+	log := logr.FromContextOrDiscard(context.TODO())
+
+	// both files are newest first, and they overlap
+	configData := config.Config{
+		HistoryFiles: []config.HistoryFile{
+			{
+				Year: 2024,
+				Path: "../test-data/testdata-unordered-2024.csv",
+			},
+			{
+				Year: 2023,
+				Path: "../test-data/testdata-unordered-2023.csv",
+			},
+		},
+	}
+
+	summary := processAllHistoryFiles(log, []string{}, []string{}, configData, testAsOf)
+
+	disposals := summary.DisposalsData[2024]
+	assert.Len(t, disposals, 2)
+
+	// the 2024-02-01 sale is matched against the 2023-12-01 buy from the other
+	// file first
+	assert.Equal(t, "TESTID_5", disposals[0].ID)
+	assert.Equal(t, "TESTID_1", disposals[0].Lots[0].BuyID)
+	assertEqualDecimals(t, decimal.NewFromInt(50), disposals[0].Profit)
+
+	// the buy at the same instant as the sale is processed first
+	assert.Equal(t, "TESTID_4", disposals[1].ID)
+	assert.Equal(t, "TESTID_3", disposals[1].Lots[0].BuyID)
+	assertEqualDecimals(t, decimal.NewFromInt(40), disposals[1].Profit)
+}
+
+func TestProcessAllHistoryFilesDuplicates(t *testing.T) {
+	log := logr.FromContextOrDiscard(context.TODO())
+
+	// the 2024 export starts in the middle of 2023, two of the repeated rows
+	// have no ID and are the same, they are two fills in the 2023 export
+	configData := config.Config{
+		HistoryFiles: []config.HistoryFile{
+			{
+				Year: 2023,
+				Path: "../test-data/testdata-duplicates-2023.csv",
+			},
+			{
+				Year: 2024,
+				Path: "../test-data/testdata-duplicates-2024.csv",
+			},
+		},
+	}
+
+	summary := processAllHistoryFiles(log, []string{}, []string{}, configData, testAsOf)
+
+	assert.Len(t, summary.DuplicatesData, 3)
+	assert.Equal(t, "TESTID_2", summary.DuplicatesData[0].Record.ID)
+	assert.Equal(t, "../test-data/testdata-duplicates-2024.csv", summary.DuplicatesData[0].Source)
+	assert.Equal(t, "../test-data/testdata-duplicates-2023.csv", summary.DuplicatesData[0].FirstSource)
+	assert.Empty(t, summary.DuplicatesData[1].Record.ID)
+	assert.Empty(t, summary.DuplicatesData[2].Record.ID)
+
+	// both KIMI451 fills are kept: 10 * 30 - 2 * 100
+	disposals := summary.DisposalsData[2024]
+	assert.Len(t, disposals, 2)
+	assertEqualDecimals(t, decimal.NewFromInt(80), disposals[0].Profit)
+	assertEqualDecimals(t, decimal.NewFromInt(100), disposals[1].Profit)
+}
+
+func TestProcessAllHistoryFilesDirectory(t *testing.T) {
+	log := logr.FromContextOrDiscard(context.TODO())
+
+	// the file declared for 2024 has a sale in 2025
+	configData := config.Config{
+		HistoryFiles: []config.HistoryFile{
+			{
+				Year: 2024,
+				Path: "../test-data/testdata-declared-year.csv",
+			},
+		},
+		HistoryPaths: []string{"../test-data/exports"},
+	}
+
+	summary := processAllHistoryFiles(log, []string{}, []string{}, configData, testAsOf)
+
+	assert.Equal(t, []int{2023, 2024, 2025}, summary.Years)
+
+	assert.Len(t, summary.HistoryFilesData, 3)
+	assert.Equal(t, []int{2024, 2025}, summary.HistoryFilesData[0].Years)
+	assert.Equal(t, 1, summary.HistoryFilesData[0].RowsOutsideYear)
+	assert.Equal(t, "../test-data/exports/testdata-exports-2023.csv", summary.HistoryFilesData[1].Path)
+	assert.Zero(t, summary.HistoryFilesData[1].DeclaredYear)
+	assert.Zero(t, summary.HistoryFilesData[1].RowsOutsideYear)
+
+	assertEqualDecimals(t, decimal.NewFromInt(10), summary.ProfitsData[2023].Stock)
+	assertEqualDecimals(t, decimal.NewFromInt(50), summary.ProfitsData[2024].Stock)
+	assertEqualDecimals(t, decimal.NewFromInt(30), summary.ProfitsData[2025].Stock)
+}
+
+func TestReadAllSourcesGlob(t *testing.T) {
+	log := logr.FromContextOrDiscard(context.TODO())
+
+	// the listed file is also matched by the glob, it is only read once and
+	// keeps its declared year
+	configData := config.Config{
+		HistoryFiles: []config.HistoryFile{
+			{
+				Year: 2023,
+				Path: "../test-data/exports/testdata-exports-2023.csv",
+			},
+		},
+		HistoryPaths: []string{"../test-data/exports/*-2023.csv", "../test-data/exports/*-2024.csv"},
+	}
+
+	summary := Report{}
+	_, err := readAllSources(log, &summary, configData)
+	assert.NoError(t, err)
+	assert.Len(t, summary.HistoryFilesData, 2)
+	assert.Equal(t, "../test-data/exports/testdata-exports-2023.csv", summary.HistoryFilesData[0].Path)
+	assert.Equal(t, 2023, summary.HistoryFilesData[0].DeclaredYear)
+	assert.Equal(t, "../test-data/exports/testdata-exports-2024.csv", summary.HistoryFilesData[1].Path)
+	assert.Zero(t, summary.HistoryFilesData[1].DeclaredYear)
+	assert.Empty(t, summary.DuplicatesData)
+
+	configData.HistoryPaths = []string{"../test-data/exports/*-2030.csv"}
+	_, err = readAllSources(log, &Report{}, configData)
+	assert.ErrorContains(t, err, "no history files found")
+}
+
+func TestReadAllSourcesDuplicateConflict(t *testing.T) {
+	log := logr.FromContextOrDiscard(context.TODO())
+
+	// the same ID with a different price
+	configData := config.Config{
+		HistoryFiles: []config.HistoryFile{
+			{
+				Year: 2023,
+				Path: "../test-data/testdata-duplicates-2023.csv",
+			},
+			{
+				Year: 2023,
+				Path: "../test-data/testdata-duplicates-conflict.csv",
+			},
+		},
+	}
+
+	_, err := readAllSources(log, &Report{}, configData)
+	assert.ErrorContains(t, err, "records with the ID 'TESTID_2'")
+}
+
+func TestProcessAllHistoryFilesDividends(t *testing.T) {
+	log := logr.FromContextOrDiscard(context.TODO())
+
+	configData := config.Config{
+		HistoryFiles: []config.HistoryFile{
+			{
+				Year: 2024,
+				Path: "../test-data/testdata-dividends.csv",
+			},
+		},
+	}
+
+	summary := processAllHistoryFiles(log, []string{}, []string{}, configData, testAsOf)
+
+	// the US withholding tax is capped at 15% of the gross, 30% was taken from
+	// the first dividend. Germany withholds 26.375%.
+	dividends := summary.DividendsData[2024]
+	assertEqualDecimals(t, decimal.NewFromInt(200), dividends.Gross)
+	assertEqualDecimals(t, decimal.RequireFromString("48.875"), dividends.WithholdingTax)
+	assertEqualDecimals(t, decimal.RequireFromString("151.125"), dividends.Net)
+	assertEqualDecimals(t, decimal.NewFromInt(30), dividends.TaxCredit)
+	assertEqualDecimals(t, decimal.RequireFromString("18.875"), dividends.ExcessWithholdingTax)
+
+	assert.Len(t, dividends.Countries, 2)
+	assert.Equal(t, "DE", dividends.Countries[0].Country)
+	assertEqualDecimals(t, decimal.NewFromInt(15), dividends.Countries[0].TaxCredit)
+	assert.Equal(t, "US", dividends.Countries[1].Country)
+	assertEqualDecimals(t, decimal.NewFromInt(100), dividends.Countries[1].Gross)
+	assertEqualDecimals(t, decimal.RequireFromString("22.5"), dividends.Countries[1].WithholdingTax)
+	assertEqualDecimals(t, decimal.NewFromInt(15), dividends.Countries[1].TaxCredit)
+
+	assert.Len(t, dividends.Credits, 3)
+	assertEqualDecimals(t, decimal.NewFromInt(15), dividends.Credits[0].Payment.WithholdingTax)
+	assertEqualDecimals(t, decimal.RequireFromString("7.5"), dividends.Credits[0].TaxCredit)
+
+	// there is no treaty rate for the Cayman Islands
+	dividends = summary.DividendsData[2025]
+	assert.False(t, dividends.Credits[0].HasTreaty)
+	assert.True(t, dividends.TaxCredit.IsZero())
+	assertEqualDecimals(t, decimal.NewFromInt(10), dividends.ExcessWithholdingTax)
+
+	// the treaty rates can be overridden
+	configData.TreatyRates = map[string]decimal.Decimal{"KY": decimal.RequireFromString("0.05")}
+	summary = processAllHistoryFiles(log, []string{}, []string{}, configData, testAsOf)
+	assertEqualDecimals(t, decimal.NewFromInt(5), summary.DividendsData[2025].TaxCredit)
+}
+
+func TestProcessAllHistoryFilesDividendAdjustment(t *testing.T) {
+	log := logr.FromContextOrDiscard(context.TODO())
+
+	configData := config.Config{
+		HistoryFiles: []config.HistoryFile{
+			{
+				Year: 2024,
+				Path: "../test-data/testdata-dividend-adjustment.csv",
+			},
+		},
+	}
+
+	summary := processAllHistoryFiles(log, []string{}, []string{}, configData, testAsOf)
+
+	// the adjustment takes back 10 gross, of which 1.5 was withheld, and the
+	// 15% credit on it
+	dividends := summary.DividendsData[2024]
+	assert.Len(t, dividends.Credits, 2)
+	adjustment := dividends.Credits[1]
+	assertEqualDecimals(t, decimal.NewFromInt(-10), adjustment.Payment.Gross)
+	assertEqualDecimals(t, decimal.RequireFromString("-1.5"), adjustment.Payment.WithholdingTax)
+	assertEqualDecimals(t, decimal.RequireFromString("-8.5"), adjustment.Payment.Net)
+	assertEqualDecimals(t, decimal.RequireFromString("-1.5"), adjustment.TaxCredit)
+	assert.True(t, adjustment.ExcessWithholdingTax.IsZero())
+
+	assertEqualDecimals(t, decimal.NewFromInt(40), dividends.Gross)
+	assertEqualDecimals(t, decimal.RequireFromString("13.5"), dividends.WithholdingTax)
+	assertEqualDecimals(t, decimal.RequireFromString("26.5"), dividends.Net)
+	assertEqualDecimals(t, decimal.NewFromInt(6), dividends.TaxCredit)
+	assertEqualDecimals(t, decimal.RequireFromString("7.5"), dividends.ExcessWithholdingTax)
+}
+
+func TestProcessAllHistoryFilesFundDistributions(t *testing.T) {
+	log := logr.FromContextOrDiscard(context.TODO())
+
+	configData := config.Config{
+		HistoryFiles: []config.HistoryFile{
+			{
+				Path: "../test-data/testdata-fund-distributions.csv",
+			},
+		},
+	}
+
+	summary := processAllHistoryFiles(log, []string{}, []string{}, configData, testAsOf)
+
+	// the VUSA distributions are not share dividends
+	dividends := summary.DividendsData[2024]
+	assert.Len(t, dividends.Credits, 1)
+	assertEqualDecimals(t, decimal.NewFromInt(50), dividends.Gross)
+
+	// 20 + 25 at the 41% exit tax rate
+	fundIncome := summary.FundIncomeData[2024]
+	assert.Len(t, fundIncome.Distributions, 2)
+	assertEqualDecimals(t, decimal.NewFromInt(45), fundIncome.Gross)
+	assertEqualDecimals(t, decimal.NewFromInt(45), fundIncome.Net)
+	assertEqualDecimals(t, decimal.RequireFromString("18.45"), fundIncome.Tax)
+
+	// the rate is 38% from 2026
+	fundIncome = summary.FundIncomeData[2026]
+	assertEqualDecimals(t, decimal.RequireFromString("0.38"), fundIncome.Distributions[0].Rate)
+	assertEqualDecimals(t, decimal.RequireFromString("7.6"), fundIncome.Tax)
+	_, ok := summary.DividendsData[2026]
+	assert.False(t, ok)
+}
+
+func TestProcessAllHistoryFilesBuiltInSplits(t *testing.T) {
+	log := logr.FromContextOrDiscard(context.TODO())
+
+	configData := config.Config{
+		HistoryFiles: []config.HistoryFile{
+			{
+				Path: "../test-data/testdata-early-splits.csv",
+			},
+		},
+	}
+
+	summary := processAllHistoryFiles(log, []string{}, []string{}, configData, testAsOf)
+
+	// the TSLA share bought in 2020 is 15 shares after the 1:5 split of
+	// 2020-08-31 and the 1:3 split of 2022-08-25
+	disposals := summary.DisposalsData[2023]
+	assert.Len(t, disposals, 1)
+	assertEqualDecimals(t, decimal.NewFromInt(15), disposals[0].Lots[0].Quantity)
+	assertEqualDecimals(t, decimal.NewFromInt(750), summary.ProfitsData[2023].Overall)
+
+	// the NVDA share bought in 2021 is 40 shares after the 1:4 split of
+	// 2021-07-20 and the 1:10 split of 2024-06-10
+	disposals = summary.DisposalsData[2024]
+	assert.Len(t, disposals, 1)
+	assertEqualDecimals(t, decimal.NewFromInt(40), disposals[0].Lots[0].Quantity)
+	assertEqualDecimals(t, decimal.NewFromInt(3480), summary.ProfitsData[2024].Overall)
+}
+
+func TestProcessAllHistoryFilesDeemedDisposals(t *testing.T) {
+	log := logr.FromContextOrDiscard(context.TODO())
+
+	configData := config.Config{
+		HistoryFiles: []config.HistoryFile{
+			{
+				Year: 2024,
+				Path: "../test-data/testdata-deemed-disposal-2024.csv",
+			},
+			{
+				Year: 2015,
+				Path: "../test-data/testdata-deemed-disposal-2015.csv",
+			},
+			{
+				Year: 2016,
+				Path: "../test-data/testdata-deemed-disposal-2016.csv",
+			},
+		},
+		PricesFile: "../test-data/testdata-prices.json",
+	}
+
+	summary := processAllHistoryFiles(log, []string{}, []string{}, configData, testAsOf)
+
+	// first lot: 10 * 70 - 400 at 41% on 2023-02-02
+	assert.Len(t, summary.DeemedDisposalsData[2023], 1)
+	assertEqualDecimals(t, decimal.NewFromInt(300), summary.DeemedDisposalsData[2023][0].Gain)
+	assertEqualDecimals(t, decimal.NewFromInt(123), summary.DeemedDisposalsData[2023][0].Tax)
+	assertEqualDecimals(t, decimal.NewFromInt(123), summary.FundTaxData[2023].Tax)
+
+	// second lot: 10 * 80 - 350 at 41% on 2024-03-01
+	assert.Len(t, summary.DeemedDisposalsData[2024], 1)
+	assertEqualDecimals(t, decimal.NewFromFloat(184.5), summary.DeemedDisposalsData[2024][0].Tax)
+
+	// the real sale of the first lot is credited with the 2023 deemed
+	// disposal tax: 500 * 0.41 - 123
+	fundTax := summary.FundTaxData[2024]
+	assert.Len(t, fundTax.Disposals, 1)
+	assertEqualDecimals(t, decimal.NewFromInt(123), fundTax.Disposals[0].DeemedDisposalCredit)
+	assertEqualDecimals(t, decimal.NewFromInt(82), fundTax.Disposals[0].Tax)
+	assertEqualDecimals(t, decimal.NewFromFloat(184.5), fundTax.DeemedDisposalTax)
+	assertEqualDecimals(t, decimal.NewFromFloat(266.5), fundTax.Tax)
+
+	assert.Len(t, summary.UpcomingDeemedDisposals, 1)
+	assert.Equal(t, "2032-03-01", summary.UpcomingDeemedDisposals[0].Date.Format(time.DateOnly))
+	assertEqualDecimals(t, decimal.NewFromInt(450), summary.UpcomingDeemedDisposals[0].Gain)
+}
+
+func TestProcessAllHistoryFilesDeemedDisposalsUnpriced(t *testing.T) {
+	log := logr.FromContextOrDiscard(context.TODO())
+
+	// the only price is two months before the anniversary on 2023-02-02, so
+	// it is not used and the anniversary is left pending
+	configData := config.Config{
+		HistoryFiles: []config.HistoryFile{
+			{
+				Year: 2015,
+				Path: "../test-data/testdata-deemed-disposal-2015.csv",
+			},
+		},
+		PricesFile: "../test-data/testdata-prices-stale.json",
+	}
+
+	summary := processAllHistoryFiles(log, []string{}, []string{}, configData, testAsOf)
+
+	// it is reported once, without a value or tax
+	assert.Len(t, summary.DeemedDisposalsData[2023], 1)
+	deemedDisposal := summary.DeemedDisposalsData[2023][0]
+	assert.False(t, deemedDisposal.Priced)
+	assertEqualDecimals(t, decimal.NewFromInt(0), deemedDisposal.Tax)
+
+	// the lot is still due its first anniversary
+	assert.Len(t, summary.UpcomingDeemedDisposals, 1)
+	assert.Equal(t, "2031-02-02", summary.UpcomingDeemedDisposals[0].Date.Format(time.DateOnly))
+
+	bookkeeper := trading212.NewBookkeeperFromReferenceData(trading212.ReferenceData{
+		Prices:           trading212.NewPriceBook(),
+		ExitTaxRates:     tax.NewParameterTable(nil),
+		Classifications:  trading212.NewClassificationRegistry(),
+		CorporateActions: trading212.NewCorporateActions(),
+	})
+	records, err := readAllSources(log, &Report{}, configData)
+	assert.NoError(t, err)
+	assert.NoError(t, processRecords(log, bookkeeper, records, []string{}, []string{}))
+	assert.NoError(t, bookkeeper.ProcessDeemedDisposals(log, testAsOf))
+	assert.NoError(t, bookkeeper.ProcessDeemedDisposals(log, testAsOf))
+	assert.Len(t, bookkeeper.GetDeemedDisposalsForYear(2023), 1)
+	lots := bookkeeper.(*trading212.BookKeeperStruct).Get("IE00B3XXRP09").GetRecordQueue().GetQueue()
+	assert.Equal(t, 0, lots[0].DeemedDisposalCount)
+}
+
+func TestCalculateLiabilities(t *testing.T) {
+	log := logr.FromContextOrDiscard(context.TODO())
+
+	summary := Report{
+		ProfitAggregatesData: map[int]trading212.StockSummary{
+			2022: {Stock: decimal.NewFromInt(1000), Overall: decimal.NewFromInt(1000)},
+			2023: {Stock: decimal.NewFromInt(5000), Overall: decimal.NewFromInt(5000)},
+			2024: {Stock: decimal.NewFromInt(4270), Overall: decimal.NewFromInt(4270)},
+		},
+		LossAggregatesData: map[int]trading212.StockSummary{
+			2022: {Stock: decimal.NewFromInt(-3000), Overall: decimal.NewFromInt(-3000)},
+			2023: {Stock: decimal.NewFromInt(-500), Overall: decimal.NewFromInt(-500)},
+		},
+		LiabilitiesData: make(map[int]tax.Liability),
+	}
+	parameterTable := tax.NewParameterTable([]tax.Parameters{
+		{
+			FromYear:        2024,
+			CGTRate:         decimal.NewFromFloat(0.4),
+			AnnualExemption: decimal.NewFromInt(1270),
+		},
+	})
+
+	err := calculateLiabilities(log, &summary, parameterTable)
+	assert.NoError(t, err)
+
+	assertEqualDecimals(t, decimal.NewFromInt(0), summary.LiabilitiesData[2022].Tax)
+	assertEqualDecimals(t, decimal.NewFromInt(2000), summary.LiabilitiesData[2022].LossesCarriedForward)
+
+	// 5000 - 500 current year losses - 2000 brought forward - 1270 exemption
+	assertEqualDecimals(t, decimal.NewFromFloat(0.33), summary.LiabilitiesData[2023].Rate)
+	assertEqualDecimals(t, decimal.NewFromInt(2000), summary.LiabilitiesData[2023].LossesBroughtForwardUsed)
+	assertEqualDecimals(t, decimal.NewFromInt(1230), summary.LiabilitiesData[2023].TaxableGains)
+	assertEqualDecimals(t, decimal.NewFromFloat(405.9), summary.LiabilitiesData[2023].Tax)
+	assertEqualDecimals(t, decimal.NewFromInt(0), summary.LiabilitiesData[2023].LossesCarriedForward)
+
+	// overridden rate from 2024
+	assertEqualDecimals(t, decimal.NewFromInt(1200), summary.LiabilitiesData[2024].Tax)
+}
+
+func TestReadHistoryFileSchema(t *testing.T) {
+	log := logr.FromContextOrDiscard(context.TODO())
+
+	// the columns are reordered, there are columns the parser does not know
+	// and the name has quotes and a backslash
+	records, mapping, _, err := readHistoryFile(config.HistoryFile{
+		Year: 2024,
+		Path: "../test-data/testdata-schema-reordered.csv",
+	}, false)
+	assert.NoError(t, err)
+	assert.Equal(t, trading212.CurrencyColumnsSchema, mapping.Schema)
+	assert.Equal(t, []string{"Finra fee", "French transaction tax"}, mapping.ExtraColumns)
+	assert.Len(t, records, 2)
+	assert.Equal(t, "TESTID_1", records[0].ID)
+	assert.Equal(t, `Kimi "450" \ Holdings`, records[0].Name)
+	assert.Equal(t, map[string]string{"French transaction tax": "0.3"}, records[0].Extra)
+	assert.Equal(t, map[string]string{"Finra fee": "0.02"}, records[1].Extra)
+	assert.Equal(t, `note with a \ backslash`, records[1].Notes)
+
+	// the account currency is in the header of the amount columns
+	records, mapping, _, err = readHistoryFile(config.HistoryFile{
+		Year: 2024,
+		Path: "../test-data/testdata-schema-legacy.csv",
+	}, false)
+	assert.NoError(t, err)
+	assert.Equal(t, trading212.LegacySchema, mapping.Schema)
+	assert.Equal(t, []string{"Charge amount (EUR)"}, mapping.ExtraColumns)
+	assert.Equal(t, "EUR", records[1].CurrencyTotal)
+	assert.Equal(t, "EUR", records[1].CurrencyResult)
+	assertEqualDecimals(t, decimal.NewFromInt(150), records[1].Total)
+
+	for _, path := range []string{
+		"../test-data/testdata-schema-reordered.csv",
+		"../test-data/testdata-schema-legacy.csv",
+	} {
+		bookkeeper := trading212.NewBookkeeper()
+		_, _, _, profits, err := processTestHistoryFile(log, bookkeeper,
+			config.HistoryFile{Year: 2024, Path: path})
+		assert.NoError(t, err)
+		assertEqualDecimals(t, decimal.NewFromInt(50), profits.Overall)
+	}
+}
+
+func TestProcessHistoryFileSignedResult(t *testing.T) {
+	log := logr.FromContextOrDiscard(context.TODO())
+
+	bookkeeper := trading212.NewBookkeeper()
+	_, _, _, profits, err := processTestHistoryFile(log, bookkeeper, config.HistoryFile{
+		Year: 2024,
+		Path: "../test-data/testdata-signed.csv",
+	})
+	assert.NoError(t, err)
+	assertEqualDecimals(t, decimal.NewFromInt(-20), profits.Overall)
+
+	records, _, _, err := readHistoryFile(config.HistoryFile{
+		Year: 2024,
+		Path: "../test-data/testdata-signed.csv",
+	}, false)
+	assert.NoError(t, err)
+	assertEqualDecimals(t, decimal.NewFromInt(-20), records[1].Result)
+}
+
+func TestReadHistoryFileBadNumbers(t *testing.T) {
+	historyFile := config.HistoryFile{
+		Year: 2024,
+		Path: "../test-data/testdata-bad-numbers.csv",
+	}
+
+	// scientific notation fails the file
+	_, _, _, err := readHistoryFile(historyFile, false)
+	cellError := trading212.CellError{}
+	assert.ErrorAs(t, err, &cellError)
+	assert.Equal(t, "../test-data/testdata-bad-numbers.csv", cellError.Path)
+	assert.Equal(t, 2, cellError.Line)
+	assert.Equal(t, 7, cellError.Column)
+	assert.Equal(t, "Price / share", cellError.Header)
+	assert.Equal(t, "1e1", cellError.Value)
+
+	// every bad value is listed in lenient mode
+	records, _, cellErrors, err := readHistoryFile(historyFile, true)
+	assert.NoError(t, err)
+	assert.Len(t, records, 2)
+	assert.Len(t, cellErrors, 2)
+	assert.Equal(t, "1,500.00", cellErrors[1].Value)
+	assert.Equal(t, 3, cellErrors[1].Line)
+	assert.Equal(t, "Total", cellErrors[1].Header)
+	assert.True(t, records[1].Total.IsZero())
+}
+
+func TestProcessAllHistoryFilesLenient(t *testing.T) {
+	log := logr.FromContextOrDiscard(context.TODO())
+
+	configData := config.Config{
+		HistoryFiles: []config.HistoryFile{
+			{
+				Year: 2024,
+				Path: "../test-data/testdata-bad-numbers.csv",
+			},
+		},
+		LenientParsing: true,
+	}
+
+	summary := processAllHistoryFiles(log, []string{}, []string{}, configData, testAsOf)
+
+	// the bad values are listed and nothing is worked out from the zeroes
+	assert.Len(t, summary.CellErrorsData, 2)
+	assert.Empty(t, summary.Years)
+	assert.Empty(t, summary.ProfitsData)
+	assert.Empty(t, summary.DisposalsData)
+	assert.Empty(t, summary.LiabilitiesData)
+	assert.Empty(t, summary.FundTaxData)
+	assert.Empty(t, summary.DividendsData)
+}
+
+func TestValidateInputs(t *testing.T) {
+	configData := config.Config{
+		HistoryFiles: []config.HistoryFile{
+			{
+				Year: 2024,
+				Path: "../test-data/testdata-validate.csv",
+			},
+		},
+	}
+
+	report := validateInputs(logr.Discard(), configData, testAsOf)
+	assert.True(t, report.HasErrors())
+
+	lines := map[Severity][]int{}
+	for _, issue := range report.Issues {
+		assert.Equal(t, "../test-data/testdata-validate.csv", issue.Path)
+		lines[issue.Severity] = append(lines[issue.Severity], issue.Line)
+	}
+	// the bad price, the unknown action, the missing exchange rate and the
+	// oversold position
+	assert.ElementsMatch(t, []int{8, 6, 3, 4}, lines[ErrorSeverity])
+	// the Total that does not match and the row in 2025
+	assert.ElementsMatch(t, []int{5, 7}, lines[WarningSeverity])
+
+	// the files that are processed without errors are valid
+	configData = config.Config{
+		HistoryFiles: []config.HistoryFile{
+			{
+				Year: 2022,
+				Path: "../test-data/testdata-2022.csv",
+			},
+			{
+				Year: 2023,
+				Path: "../test-data/testdata-2023.csv",
+			},
+			{
+				Year: 2025,
+				Path: "../test-data/testdata-2025.csv",
+			},
+		},
+	}
+	report = validateInputs(logr.Discard(), configData, testAsOf)
+	assert.False(t, report.HasErrors(), report.Issues)
+}
+
+func TestValidateInputsCorporateActions(t *testing.T) {
+	// the sales of the spun off shares, of the shares after an ISIN change
+	// and of the shares after a merger are checked on the holdings of the
+	// bookkeeper, so they are valid
+	for _, name := range []string{"spin-off", "ticker-change", "merger"} {
+		t.Run(name, func(t *testing.T) {
+			configData := config.Config{
+				HistoryFiles: []config.HistoryFile{
+					{
+						Year: 2024,
+						Path: "../test-data/testdata-" + name + ".csv",
+					},
+				},
+				CorporateActionsFile: "../test-data/testdata-" + name + ".json",
+			}
+
+			report := validateInputs(logr.Discard(), configData, testAsOf)
+			assert.False(t, report.HasErrors(), report.Issues)
+		})
+	}
+}
+
+func TestValidateInputsAfterLastRow(t *testing.T) {
+	// the merger is after the last row, it is processed up to the as of
+	// date and has no price for the new shares
+	configData := config.Config{
+		HistoryFiles: []config.HistoryFile{
+			{
+				Year: 2024,
+				Path: "../test-data/testdata-validate-merger.csv",
+			},
+		},
+		CorporateActionsFile: "../test-data/testdata-validate-merger.json",
+	}
+
+	report := validateInputs(logr.Discard(), configData, testAsOf)
+	assert.Len(t, report.Issues, 1)
+	assert.Equal(t, ErrorSeverity, report.Issues[0].Severity)
+	assert.Contains(t, report.Issues[0].Message, "no NewSharePrice or recent price for 'XX0000000012'")
+
+	// before the merger there is nothing to check
+	report = validateInputs(logr.Discard(), configData, time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+	assert.Empty(t, report.Issues)
+}
+
+func TestValidateInputsUnreadSource(t *testing.T) {
+	// without the opening lot the sale is of more shares than are bought,
+	// the holdings are not checked as the opening lots could not be read
+	configData := config.Config{
+		HistoryFiles: []config.HistoryFile{
+			{
+				Year: 2024,
+				Path: "../test-data/testdata-opening-lots.csv",
+			},
+		},
+		OpeningLotsFile: "../test-data/testdata-missing.json",
+	}
+
+	report := validateInputs(logr.Discard(), configData, testAsOf)
+	assert.Len(t, report.Issues, 2)
+	assert.Equal(t, ErrorSeverity, report.Issues[0].Severity)
+	assert.Equal(t, "../test-data/testdata-missing.json", report.Issues[0].Path)
+	assert.Equal(t, WarningSeverity, report.Issues[1].Severity)
+	assert.Contains(t, report.Issues[1].Message, "the holdings are not checked")
+}
+
+func TestProcessHistoryFileActions(t *testing.T) {
+	log := logr.FromContextOrDiscard(context.TODO())
+
+	// every kind of row, only the buys and sells change the gains
+	bookkeeper := trading212.NewBookkeeper()
+	_, _, _, profits, err := processTestHistoryFile(log, bookkeeper, config.HistoryFile{
+		Year: 2024,
+		Path: "../test-data/testdata-actions.csv",
+	})
+	assert.NoError(t, err)
+	// (8*15 - 8*10) + (7*15 - (2*10 + 5*12))
+	assertEqualDecimals(t, decimal.NewFromInt(65), profits.Overall)
+
+	records, _, _, err := readHistoryFile(config.HistoryFile{
+		Year: 2024,
+		Path: "../test-data/testdata-actions.csv",
+	}, false)
+	assert.NoError(t, err)
+	assert.Equal(t, trading212.Deposit, records[0].Action)
+	assert.Equal(t, trading212.LimitBuy, records[1].Action)
+	assert.Equal(t, trading212.Dividend, records[3].Action)
+	assert.Equal(t, trading212.DividendKind, records[3].Action.GetKind())
+	assert.Equal(t, trading212.CashKind, records[7].Action.GetKind())
+	assert.Equal(t, trading212.SellKind, records[9].Action.GetKind())
+
+	// the "buy" and "sell" of older exports are market orders
+	records, _, _, err = readHistoryFile(config.HistoryFile{
+		Year: 2022,
+		Path: "../test-data/testdata-2022.csv",
+	}, false)
+	assert.NoError(t, err)
+	assert.Equal(t, trading212.MarketBuy, records[0].Action)
+	assert.Equal(t, trading212.MarketSell, records[5].Action)
+
+	// an action that is not known fails the file
+	_, _, _, err = readHistoryFile(config.HistoryFile{
+		Year: 2024,
+		Path: "../test-data/testdata-unknown-action.csv",
+	}, false)
+	cellError := trading212.CellError{}
+	assert.ErrorAs(t, err, &cellError)
+	assert.Equal(t, 3, cellError.Line)
+	assert.Equal(t, "Free shares", cellError.Value)
+
+	// a dividend type that may not be income is not taken as a dividend
+	_, _, _, err = readHistoryFile(config.HistoryFile{
+		Year: 2024,
+		Path: "../test-data/testdata-unknown-dividend.csv",
+	}, false)
+	assert.ErrorAs(t, err, &cellError)
+	assert.Equal(t, 3, cellError.Line)
+	assert.Equal(t, "Dividend (Demerger)", cellError.Value)
+	assert.ErrorContains(t, err, "unknown dividend type")
+}
+
+func TestProcessHistoryFileWashSaleEasy(t *testing.T) {
+	log := logr.FromContextOrDiscard(context.TODO())
+
+	bookkeeper := trading212.NewBookkeeper()
+
+	historyFile := config.HistoryFile{
+		Year: 2024,
+		Path: "../test-data/testdata-wash-sale.csv",
+	}
+	saleAggregates, profitAggregates, lossAggregates, profits, err := processTestHistoryFile(log, bookkeeper, historyFile)
+
+	assert.NoError(t, err)
+	t.Log(profits.Overall)
+
+	// REGULAR makes 100, the ABC123 loss of 100 is ring-fenced and 90 of it
+	// is released against the gain on the reacquired shares
+	assertEqualDecimals(t, decimal.NewFromInt(100), profits.Overall)
+	assertEqualDecimals(t, decimal.NewFromInt(1540), saleAggregates.Overall)
+	assertEqualDecimals(t, decimal.NewFromInt(0), lossAggregates.Overall)
+	assertEqualDecimals(t, decimal.NewFromInt(100), profitAggregates.Overall)
+	assertEqualDecimals(t, decimal.NewFromInt(-100), bookkeeper.GetRestrictedLossAggregatesForYear(2024).Overall)
+
+	disposals := bookkeeper.GetDisposalsForYear(2024)
+	assert.Len(t, disposals, 3)
+	assertEqualDecimals(t, decimal.NewFromInt(-100), disposals[0].RestrictedLoss)
+	assert.Equal(t, "ABC123", disposals[1].Ticker)
+	assertEqualDecimals(t, decimal.NewFromInt(-90), disposals[1].RingFencedLossUsed)
+	assertEqualDecimals(t, decimal.NewFromInt(-10), disposals[1].RingFencedLossForfeited)
+}
+
+func TestProcessHistoryFileWashSaleComplex(t *testing.T) {
+	log := logr.FromContextOrDiscard(context.TODO())
+
+	bookkeeper := trading212.NewBookkeeper()
+
+	historyFile := config.HistoryFile{
+		Year: 2024,
+		Path: "../test-data/testdata-wash-sale-complex.csv",
+	}
+	saleAggregates, profitAggregates, lossAggregates, profits, err := processTestHistoryFile(log, bookkeeper, historyFile)
+
+	assert.NoError(t, err)
+
+	assertEqualDecimals(t, decimal.NewFromInt(100), profits.Overall)
+	assertEqualDecimals(t, decimal.NewFromInt(1500), saleAggregates.Overall)
+	assertEqualDecimals(t, decimal.NewFromInt(0), lossAggregates.Overall)
+	assertEqualDecimals(t, decimal.NewFromInt(100), profitAggregates.Overall)
+	assertEqualDecimals(t, decimal.NewFromInt(-125), bookkeeper.GetRestrictedLossAggregatesForYear(2024).Overall)
+
+	disposals := bookkeeper.GetDisposalsForYear(2024)
+	assert.Len(t, disposals, 3)
+	// the first pot goes with the reacquired shares sold at a loss
+	assertEqualDecimals(t, decimal.NewFromInt(-50), disposals[1].RingFencedLossForfeited)
+	assertEqualDecimals(t, decimal.NewFromInt(-25), disposals[1].RestrictedLoss)
+	assertEqualDecimals(t, decimal.NewFromInt(-75), disposals[2].RingFencedLossUsed)
+	assertEqualDecimals(t, decimal.NewFromInt(175), disposals[2].Profit)
+}
+
+func TestProcessHistoryFileWashSaleForfeit(t *testing.T) {
+	log := logr.FromContextOrDiscard(context.TODO())
+
+	bookkeeper := trading212.NewBookkeeper()
+
+	historyFile := config.HistoryFile{
+		Year: 2024,
+		Path: "../test-data/testdata-wash-sale-forfeit.csv",
+	}
+	_, _, lossAggregates, profits, err := processTestHistoryFile(log, bookkeeper, historyFile)
+	assert.NoError(t, err)
+
+	// the pot of 100 is larger than the gain of 20 on the reacquired shares,
+	// 20 of it is used and the rest is lost with the shares
+	disposals := bookkeeper.GetDisposalsForYear(2024)
+	assert.Len(t, disposals, 2)
+	assertEqualDecimals(t, decimal.NewFromInt(-100), disposals[0].RestrictedLoss)
+	assertEqualDecimals(t, decimal.NewFromInt(-20), disposals[1].RingFencedLossUsed)
+	assertEqualDecimals(t, decimal.NewFromInt(-80), disposals[1].RingFencedLossForfeited)
+	assertEqualDecimals(t, decimal.NewFromInt(0), profits.Overall)
+	assertEqualDecimals(t, decimal.NewFromInt(0), lossAggregates.Overall)
+}
+
+func TestProcessHistoryFileWashSalePartial(t *testing.T) {
+	log := logr.FromContextOrDiscard(context.TODO())
+
+	bookkeeper := trading212.NewBookkeeper()
+
+	historyFile := config.HistoryFile{
+		Year: 2024,
+		Path: "../test-data/testdata-wash-sale-partial.csv",
+	}
+	_, _, lossAggregates, profits, err := processTestHistoryFile(log, bookkeeper, historyFile)
+	assert.NoError(t, err)
+
+	// the 15 shares bought back reacquire all 10 of the first sale and 5 of
+	// the 10 of the second, the buy after both windows reacquires none
+	disposals := bookkeeper.GetDisposalsForYear(2024)
+	assert.Len(t, disposals, 2)
+	assertEqualDecimals(t, decimal.NewFromInt(-100), disposals[0].RestrictedLoss)
+	assertEqualDecimals(t, decimal.NewFromInt(-25), disposals[1].RestrictedLoss)
+	assertEqualDecimals(t, decimal.NewFromInt(-125), bookkeeper.GetRestrictedLossAggregatesForYear(2024).Overall)
+
+	// the other half of the second loss is still allowable
+	assertEqualDecimals(t, decimal.NewFromInt(-25), lossAggregates.Overall)
+	assertEqualDecimals(t, decimal.NewFromInt(-25), profits.Overall)
+}
 
 // makes the error message more readable
 func assertEqualDecimals(t *testing.T, expected, actual decimal.Decimal) {
@@ -0,0 +1,177 @@
+package tax
+
+import (
+	"cmp"
+	"slices"
+
+	"github.com/shopspring/decimal"
+	"trading212-parser.kimi450.com/pkg/trading212"
+)
+
+// IrelandCountry is the ISIN prefix of Irish instruments, the dividend
+// withholding tax deducted on them is credited in full rather than under a
+// treaty
+const IrelandCountry = "IE"
+
+// defaultTreatyRates are the withholding tax rates on dividends under the
+// double taxation treaties, the foreign tax credit is capped at them
+var defaultTreatyRates = map[string]decimal.Decimal{
+	"AT": decimal.RequireFromString("0.15"),
+	"AU": decimal.RequireFromString("0.15"),
+	"BE": decimal.RequireFromString("0.15"),
+	"CA": decimal.RequireFromString("0.15"),
+	"CH": decimal.RequireFromString("0.15"),
+	"DE": decimal.RequireFromString("0.15"),
+	"DK": decimal.RequireFromString("0.15"),
+	"ES": decimal.RequireFromString("0.15"),
+	"FI": decimal.RequireFromString("0.15"),
+	"FR": decimal.RequireFromString("0.15"),
+	"GB": decimal.RequireFromString("0.15"),
+	"IT": decimal.RequireFromString("0.15"),
+	"JP": decimal.RequireFromString("0.15"),
+	"NL": decimal.RequireFromString("0.15"),
+	"NO": decimal.RequireFromString("0.15"),
+	"PT": decimal.RequireFromString("0.15"),
+	"SE": decimal.RequireFromString("0.15"),
+	"US": decimal.RequireFromString("0.15"),
+}
+
+type TreatyRates interface {
+	// GetRate returns the treaty rate for the country, false if there is no
+	// treaty
+	GetRate(country string) (decimal.Decimal, bool)
+}
+
+type TreatyRatesStruct struct {
+	rates map[string]decimal.Decimal
+}
+
+// NewTreatyRates returns the default treaty rates with the given overrides
+// replacing or adding to them by country
+func NewTreatyRates(overrides map[string]decimal.Decimal) TreatyRates {
+	rates := map[string]decimal.Decimal{}
+	for country, rate := range defaultTreatyRates {
+		rates[country] = rate
+	}
+	for country, rate := range overrides {
+		rates[country] = rate
+	}
+	return &TreatyRatesStruct{rates: rates}
+}
+
+func (t *TreatyRatesStruct) GetRate(country string) (decimal.Decimal, bool) {
+	rate, ok := t.rates[country]
+	return rate, ok
+}
+
+// DividendCredit is the tax credit for a single dividend
+type DividendCredit struct {
+	Payment trading212.DividendPayment
+	// TreatyRate is zero when there is no treaty with the country
+	TreatyRate decimal.Decimal
+	HasTreaty  bool
+	// TaxCredit is the withholding tax up to the treaty rate, the rest is
+	// ExcessWithholdingTax which can only be claimed back from the country
+	TaxCredit            decimal.Decimal
+	ExcessWithholdingTax decimal.Decimal
+}
+
+// CountryDividends are the dividends for a tax year from one country
+type CountryDividends struct {
+	Country string
+
+	Gross                decimal.Decimal
+	WithholdingTax       decimal.Decimal
+	Net                  decimal.Decimal
+	TaxCredit            decimal.Decimal
+	ExcessWithholdingTax decimal.Decimal
+}
+
+// DividendIncome are the dividends for a tax year, the figures for the
+// foreign income section of the return
+type DividendIncome struct {
+	Year int
+
+	Gross                decimal.Decimal
+	WithholdingTax       decimal.Decimal
+	Net                  decimal.Decimal
+	TaxCredit            decimal.Decimal
+	ExcessWithholdingTax decimal.Decimal
+
+	// Countries are ordered by country code
+	Countries []CountryDividends
+	Credits   []DividendCredit
+}
+
+// NewDividendCredit works out the credit for the withholding tax on the
+// dividend, capped at the treaty rate of its country on the gross amount.
+// Irish withholding tax is credited in full and there is no credit without a
+// treaty. The credit of a negative adjustment is negative.
+func NewDividendCredit(treatyRates TreatyRates, payment trading212.DividendPayment) DividendCredit {
+	credit := DividendCredit{Payment: payment}
+
+	if payment.Country == IrelandCountry {
+		credit.TaxCredit = payment.WithholdingTax
+		return credit
+	}
+
+	credit.TreatyRate, credit.HasTreaty = treatyRates.GetRate(payment.Country)
+	credit.TaxCredit = decimal.Min(payment.WithholdingTax.Abs(), payment.Gross.Abs().Mul(credit.TreatyRate))
+	if payment.Gross.IsNegative() {
+		credit.TaxCredit = credit.TaxCredit.Neg()
+	}
+	credit.ExcessWithholdingTax = payment.WithholdingTax.Sub(credit.TaxCredit)
+	return credit
+}
+
+// CalculateDividendIncome totals the dividends per tax year and country,
+// with the tax credit for each of them
+func CalculateDividendIncome(treatyRates TreatyRates, payments []trading212.DividendPayment) []DividendIncome {
+	incomes := map[int]*DividendIncome{}
+	countries := map[int]map[string]*CountryDividends{}
+
+	for _, payment := range payments {
+		year := payment.GetYear()
+		income, ok := incomes[year]
+		if !ok {
+			income = &DividendIncome{Year: year, Credits: []DividendCredit{}}
+			incomes[year] = income
+			countries[year] = map[string]*CountryDividends{}
+		}
+		country, ok := countries[year][payment.Country]
+		if !ok {
+			country = &CountryDividends{Country: payment.Country}
+			countries[year][payment.Country] = country
+		}
+
+		credit := NewDividendCredit(treatyRates, payment)
+		income.Credits = append(income.Credits, credit)
+
+		income.Gross = income.Gross.Add(payment.Gross)
+		income.WithholdingTax = income.WithholdingTax.Add(payment.WithholdingTax)
+		income.Net = income.Net.Add(payment.Net)
+		income.TaxCredit = income.TaxCredit.Add(credit.TaxCredit)
+		income.ExcessWithholdingTax = income.ExcessWithholdingTax.Add(credit.ExcessWithholdingTax)
+
+		country.Gross = country.Gross.Add(payment.Gross)
+		country.WithholdingTax = country.WithholdingTax.Add(payment.WithholdingTax)
+		country.Net = country.Net.Add(payment.Net)
+		country.TaxCredit = country.TaxCredit.Add(credit.TaxCredit)
+		country.ExcessWithholdingTax = country.ExcessWithholdingTax.Add(credit.ExcessWithholdingTax)
+	}
+
+	result := []DividendIncome{}
+	for year, income := range incomes {
+		for _, country := range countries[year] {
+			income.Countries = append(income.Countries, *country)
+		}
+		slices.SortFunc(income.Countries, func(first, second CountryDividends) int {
+			return cmp.Compare(first.Country, second.Country)
+		})
+		result = append(result, *income)
+	}
+	slices.SortFunc(result, func(first, second DividendIncome) int {
+		return cmp.Compare(first.Year, second.Year)
+	})
+	return result
+}
@@ -0,0 +1,108 @@
+package tax
+
+import (
+	"cmp"
+	"slices"
+
+	"github.com/ansel1/merry/v2"
+	"github.com/shopspring/decimal"
+	"trading212-parser.kimi450.com/pkg/trading212"
+)
+
+// FundDisposalTax is the exit tax on a single fund disposal. The tax is
+// negative when the exit tax paid on deemed disposals of the shares is more
+// than is due on the real disposal, the difference can be claimed back.
+type FundDisposalTax struct {
+	Disposal trading212.Disposal
+	Gain     decimal.Decimal
+	Rate     decimal.Decimal
+	// DeemedDisposalCredit is the exit tax already paid on deemed disposals
+	DeemedDisposalCredit decimal.Decimal
+	Tax                  decimal.Decimal
+}
+
+// FundTax is the exit tax for a tax year, the figure for the "Offshore Funds"
+// section of the return. Losses are reported but cannot be offset.
+type FundTax struct {
+	Year int
+
+	Gains  decimal.Decimal
+	Losses decimal.Decimal
+	// DeemedDisposalTax is the part of the tax due on 8 year deemed
+	// disposals
+	DeemedDisposalTax decimal.Decimal
+	Tax               decimal.Decimal
+
+	Disposals       []FundDisposalTax
+	DeemedDisposals []trading212.DeemedDisposal
+}
+
+// CalculateFundTax works out the exit tax for every fund disposal on its own.
+// Unlike CGT, gains are taxed at the exit tax rate with no annual exemption,
+// and losses are not offset against any other gain, fund or otherwise.
+// Disposals of anything other than funds are ignored.
+// Tax on deemed disposals is due in the year of the anniversary and is
+// credited against the real disposal of the same shares.
+func CalculateFundTax(parameterTable ParameterTable, disposals []trading212.Disposal,
+	deemedDisposals []trading212.DeemedDisposal) ([]FundTax, error) {
+	fundTaxes := map[int]*FundTax{}
+	getFundTax := func(year int) *FundTax {
+		fundTax, ok := fundTaxes[year]
+		if !ok {
+			fundTax = &FundTax{
+				Year:            year,
+				Disposals:       []FundDisposalTax{},
+				DeemedDisposals: []trading212.DeemedDisposal{},
+			}
+			fundTaxes[year] = fundTax
+		}
+		return fundTax
+	}
+
+	for _, deemedDisposal := range deemedDisposals {
+		fundTax := getFundTax(deemedDisposal.GetYear())
+		fundTax.DeemedDisposalTax = fundTax.DeemedDisposalTax.Add(deemedDisposal.Tax)
+		fundTax.Tax = fundTax.Tax.Add(deemedDisposal.Tax)
+		fundTax.DeemedDisposals = append(fundTax.DeemedDisposals, deemedDisposal)
+	}
+
+	for _, disposal := range disposals {
+		if disposal.Type != trading212.ETF {
+			continue
+		}
+
+		year := disposal.GetYear()
+		parameters, err := parameterTable.GetForYear(year)
+		if err != nil {
+			return nil, merry.Errorf("failed to get tax parameters: %w", err)
+		}
+
+		fundTax := getFundTax(year)
+
+		disposalTax := FundDisposalTax{
+			Disposal:             disposal,
+			Gain:                 disposal.Profit,
+			Rate:                 parameters.ExitTaxRate,
+			DeemedDisposalCredit: disposal.DeemedDisposalCredit,
+			Tax:                  disposal.DeemedDisposalCredit.Neg(),
+		}
+		if disposal.Profit.GreaterThan(decimal.NewFromInt(0)) {
+			disposalTax.Tax = disposal.Profit.Mul(parameters.ExitTaxRate).
+				Sub(disposal.DeemedDisposalCredit).Round(2)
+			fundTax.Gains = fundTax.Gains.Add(disposal.Profit)
+		} else {
+			fundTax.Losses = fundTax.Losses.Add(disposal.Profit)
+		}
+		fundTax.Tax = fundTax.Tax.Add(disposalTax.Tax)
+		fundTax.Disposals = append(fundTax.Disposals, disposalTax)
+	}
+
+	result := []FundTax{}
+	for _, fundTax := range fundTaxes {
+		result = append(result, *fundTax)
+	}
+	slices.SortFunc(result, func(first, second FundTax) int {
+		return cmp.Compare(first.Year, second.Year)
+	})
+	return result, nil
+}
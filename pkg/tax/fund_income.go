@@ -0,0 +1,73 @@
+package tax
+
+import (
+	"cmp"
+	"slices"
+
+	"github.com/ansel1/merry/v2"
+	"github.com/shopspring/decimal"
+	"trading212-parser.kimi450.com/pkg/trading212"
+)
+
+// FundDistributionTax is the exit tax on a single fund distribution
+type FundDistributionTax struct {
+	Distribution trading212.DividendPayment
+	Rate         decimal.Decimal
+	Tax          decimal.Decimal
+}
+
+// FundIncome are the fund distributions for a tax year, the income figure for
+// the "Offshore Funds" section of the return. They are not dividends and no
+// credit is given for any withholding tax deducted from them.
+type FundIncome struct {
+	Year int
+
+	Gross          decimal.Decimal
+	WithholdingTax decimal.Decimal
+	Net            decimal.Decimal
+	Tax            decimal.Decimal
+
+	Distributions []FundDistributionTax
+}
+
+// CalculateFundIncome totals the fund distributions per tax year and works
+// out the exit tax on their gross amount at the rate of the year
+func CalculateFundIncome(parameterTable ParameterTable,
+	distributions []trading212.DividendPayment) ([]FundIncome, error) {
+	incomes := map[int]*FundIncome{}
+
+	for _, distribution := range distributions {
+		year := distribution.GetYear()
+		rate, err := parameterTable.GetExitTaxRate(year)
+		if err != nil {
+			return nil, merry.Errorf("failed to get exit tax rate: %w", err)
+		}
+
+		income, ok := incomes[year]
+		if !ok {
+			income = &FundIncome{Year: year, Distributions: []FundDistributionTax{}}
+			incomes[year] = income
+		}
+
+		distributionTax := FundDistributionTax{
+			Distribution: distribution,
+			Rate:         rate,
+			Tax:          distribution.Gross.Mul(rate).Round(2),
+		}
+		income.Distributions = append(income.Distributions, distributionTax)
+
+		income.Gross = income.Gross.Add(distribution.Gross)
+		income.WithholdingTax = income.WithholdingTax.Add(distribution.WithholdingTax)
+		income.Net = income.Net.Add(distribution.Net)
+		income.Tax = income.Tax.Add(distributionTax.Tax)
+	}
+
+	result := []FundIncome{}
+	for _, income := range incomes {
+		result = append(result, *income)
+	}
+	slices.SortFunc(result, func(first, second FundIncome) int {
+		return cmp.Compare(first.Year, second.Year)
+	})
+	return result, nil
+}
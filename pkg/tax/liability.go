@@ -0,0 +1,128 @@
+package tax
+
+import (
+	"cmp"
+	"slices"
+	"time"
+
+	"github.com/ansel1/merry/v2"
+	"github.com/shopspring/decimal"
+	"trading212-parser.kimi450.com/pkg/trading212"
+)
+
+// YearlyGains are the chargeable gains and allowable losses of a tax year,
+// along with the part of them made in the initial period. Losses are
+// negative.
+type YearlyGains struct {
+	Year   int
+	Gains  decimal.Decimal
+	Losses decimal.Decimal
+
+	InitialPeriodGains  decimal.Decimal
+	InitialPeriodLosses decimal.Decimal
+}
+
+// Instalment is the CGT to pay for a payment period. The later period is
+// whatever is left of the year's liability after the initial period, so it
+// is negative when December losses mean too much was paid in December.
+type Instalment struct {
+	Period  trading212.Period
+	DueDate time.Time
+	Tax     decimal.Decimal
+}
+
+// Liability is the CGT due for a tax year along with the steps taken to get
+// there. Losses are positive amounts here.
+type Liability struct {
+	Year int
+
+	Gains                    decimal.Decimal
+	CurrentYearLossesUsed    decimal.Decimal
+	LossesBroughtForward     decimal.Decimal
+	LossesBroughtForwardUsed decimal.Decimal
+	AnnualExemptionUsed      decimal.Decimal
+	TaxableGains             decimal.Decimal
+	Rate                     decimal.Decimal
+	Tax                      decimal.Decimal
+	LossesCarriedForward     decimal.Decimal
+
+	Instalments []Instalment
+}
+
+// GetDueDate returns the date the CGT for the payment period has to be paid by
+func GetDueDate(year int, period trading212.Period) time.Time {
+	if period == trading212.LaterPeriod {
+		return time.Date(year+1, time.January, 31, 0, 0, 0, 0, time.UTC)
+	}
+	return time.Date(year, time.December, 15, 0, 0, 0, 0, time.UTC)
+}
+
+// CalculateLiabilities works out the CGT for each year in order, carrying
+// unused losses into the following years. Per year the gains are reduced by
+// the current year losses, then by the losses brought forward, then by the
+// annual exemption before the rate is applied.
+// The initial period instalment is worked out the same way from the gains
+// and losses up to the end of November.
+func CalculateLiabilities(parameterTable ParameterTable, yearlyGains []YearlyGains) ([]Liability, error) {
+	yearlyGains = slices.Clone(yearlyGains)
+	slices.SortFunc(yearlyGains, func(first, second YearlyGains) int {
+		return cmp.Compare(first.Year, second.Year)
+	})
+
+	liabilities := []Liability{}
+	carriedForward := decimal.NewFromInt(0)
+	for _, gains := range yearlyGains {
+		parameters, err := parameterTable.GetForYear(gains.Year)
+		if err != nil {
+			return liabilities, merry.Errorf("failed to get tax parameters: %w", err)
+		}
+
+		initialPeriodLiability := calculateLiability(parameters, carriedForward,
+			gains.InitialPeriodGains, gains.InitialPeriodLosses)
+
+		liability := calculateLiability(parameters, carriedForward, gains.Gains, gains.Losses)
+		liability.Year = gains.Year
+		liability.Instalments = []Instalment{
+			{
+				Period:  trading212.InitialPeriod,
+				DueDate: GetDueDate(gains.Year, trading212.InitialPeriod),
+				Tax:     initialPeriodLiability.Tax,
+			},
+			{
+				Period:  trading212.LaterPeriod,
+				DueDate: GetDueDate(gains.Year, trading212.LaterPeriod),
+				Tax:     liability.Tax.Sub(initialPeriodLiability.Tax),
+			},
+		}
+		carriedForward = liability.LossesCarriedForward
+
+		liabilities = append(liabilities, liability)
+	}
+
+	return liabilities, nil
+}
+
+func calculateLiability(parameters Parameters, broughtForward,
+	gains, losses decimal.Decimal) Liability {
+	liability := Liability{
+		Gains:                gains,
+		LossesBroughtForward: broughtForward,
+		Rate:                 parameters.CGTRate,
+	}
+
+	currentYearLosses := losses.Abs()
+	liability.CurrentYearLossesUsed = decimal.Min(currentYearLosses, gains)
+	net := gains.Sub(liability.CurrentYearLossesUsed)
+	carriedForward := broughtForward.Add(currentYearLosses.Sub(liability.CurrentYearLossesUsed))
+
+	liability.LossesBroughtForwardUsed = decimal.Min(broughtForward, net)
+	net = net.Sub(liability.LossesBroughtForwardUsed)
+	carriedForward = carriedForward.Sub(liability.LossesBroughtForwardUsed)
+
+	liability.AnnualExemptionUsed = decimal.Min(parameters.AnnualExemption, net)
+	liability.TaxableGains = net.Sub(liability.AnnualExemptionUsed)
+	liability.Tax = liability.TaxableGains.Mul(parameters.CGTRate).Round(2)
+	liability.LossesCarriedForward = carriedForward
+
+	return liability
+}
@@ -0,0 +1,119 @@
+package tax
+
+import (
+	"cmp"
+	"slices"
+
+	"github.com/ansel1/merry/v2"
+	"github.com/shopspring/decimal"
+)
+
+// Parameters are the rates and allowances that apply from FromYear until
+// the next entry in the table
+type Parameters struct {
+	FromYear int `json:"FromYear"`
+
+	CGTRate         decimal.Decimal `json:"CGTRate"`
+	AnnualExemption decimal.Decimal `json:"AnnualExemption"`
+	// ExitTaxRate applies to gains on Irish-domiciled and EU UCITS funds
+	ExitTaxRate decimal.Decimal `json:"ExitTaxRate"`
+}
+
+// defaultParameters is the history of the Irish rates, only add new entries
+// so that past years keep their values
+var defaultParameters = []Parameters{
+	{
+		FromYear:        2009,
+		CGTRate:         decimal.RequireFromString("0.25"),
+		AnnualExemption: decimal.NewFromInt(1270),
+		ExitTaxRate:     decimal.RequireFromString("0.28"),
+	},
+	{
+		FromYear:        2012,
+		CGTRate:         decimal.RequireFromString("0.30"),
+		AnnualExemption: decimal.NewFromInt(1270),
+		ExitTaxRate:     decimal.RequireFromString("0.30"),
+	},
+	{
+		FromYear:        2013,
+		CGTRate:         decimal.RequireFromString("0.33"),
+		AnnualExemption: decimal.NewFromInt(1270),
+		ExitTaxRate:     decimal.RequireFromString("0.36"),
+	},
+	{
+		FromYear:        2014,
+		CGTRate:         decimal.RequireFromString("0.33"),
+		AnnualExemption: decimal.NewFromInt(1270),
+		ExitTaxRate:     decimal.RequireFromString("0.41"),
+	},
+	{
+		FromYear:        2026,
+		CGTRate:         decimal.RequireFromString("0.33"),
+		AnnualExemption: decimal.NewFromInt(1270),
+		ExitTaxRate:     decimal.RequireFromString("0.38"),
+	},
+}
+
+type ParameterTable interface {
+	GetForYear(year int) (Parameters, error)
+	GetExitTaxRate(year int) (decimal.Decimal, error)
+}
+
+type ParameterTableStruct struct {
+	parameters []Parameters
+}
+
+// NewParameterTable creates the table from the default history, with the
+// given overrides replacing or adding to it by year. Values left out of an
+// override are taken from the entry in effect for its year.
+func NewParameterTable(overrides []Parameters) ParameterTable {
+	defaults := &ParameterTableStruct{parameters: defaultParameters}
+
+	parameters := slices.Clone(defaultParameters)
+	for _, override := range overrides {
+		base, err := defaults.GetForYear(override.FromYear)
+		if err == nil {
+			if override.CGTRate.IsZero() {
+				override.CGTRate = base.CGTRate
+			}
+			if override.AnnualExemption.IsZero() {
+				override.AnnualExemption = base.AnnualExemption
+			}
+			if override.ExitTaxRate.IsZero() {
+				override.ExitTaxRate = base.ExitTaxRate
+			}
+		}
+
+		index := slices.IndexFunc(parameters, func(p Parameters) bool {
+			return p.FromYear == override.FromYear
+		})
+		if index >= 0 {
+			parameters[index] = override
+		} else {
+			parameters = append(parameters, override)
+		}
+	}
+
+	slices.SortFunc(parameters, func(first, second Parameters) int {
+		return cmp.Compare(first.FromYear, second.FromYear)
+	})
+
+	return &ParameterTableStruct{parameters: parameters}
+}
+
+func (t *ParameterTableStruct) GetForYear(year int) (Parameters, error) {
+	for i := len(t.parameters) - 1; i >= 0; i-- {
+		if t.parameters[i].FromYear <= year {
+			return t.parameters[i], nil
+		}
+	}
+	return Parameters{}, merry.Errorf("no tax parameters for year: %d", year)
+}
+
+func (t *ParameterTableStruct) GetExitTaxRate(year int) (decimal.Decimal, error) {
+	parameters, err := t.GetForYear(year)
+	if err != nil {
+		return decimal.Decimal{}, err
+	}
+	return parameters.ExitTaxRate, nil
+}
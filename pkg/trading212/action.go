@@ -0,0 +1,163 @@
+package trading212
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/ansel1/merry/v2"
+)
+
+// Action is the type of a row of the history file
+type Action string
+
+const (
+	MarketBuy     Action = "Market buy"
+	LimitBuy      Action = "Limit buy"
+	StopBuy       Action = "Stop buy"
+	StopLimitBuy  Action = "Stop limit buy"
+	MarketSell    Action = "Market sell"
+	LimitSell     Action = "Limit sell"
+	StopSell      Action = "Stop sell"
+	StopLimitSell Action = "Stop limit sell"
+
+	Deposit    Action = "Deposit"
+	Withdrawal Action = "Withdrawal"
+
+	// Dividend covers the "Dividend (...)" rows of the dividendIncomeTypes,
+	// e.g. "Dividend (Ordinary)"
+	Dividend           Action = "Dividend"
+	ReturnOfCapital    Action = "Dividend (Return of capital)"
+	DividendAdjustment Action = "Dividend adjustment"
+
+	InterestOnCash     Action = "Interest on cash"
+	LendingInterest    Action = "Lending interest"
+	CurrencyConversion Action = "Currency conversion"
+
+	StockSplitOpen  Action = "Stock split open"
+	StockSplitClose Action = "Stock split close"
+
+	// Takeover, SharesRemoval, NewShares and TakeoverCash are the rows of a
+	// takeover or merger, the shares and cash they move are applied from the
+	// corporate actions instead
+	Takeover      Action = "Takeover"
+	SharesRemoval Action = "Shares removal"
+	NewShares     Action = "New shares"
+	TakeoverCash  Action = "Takeover cash"
+
+	CardDebit        Action = "Card debit"
+	CardCredit       Action = "Card credit"
+	SpendingCashback Action = "Spending cashback"
+
+	// OpeningBuy and SpinOffBuy are the actions of the lots created by the
+	// parser, for opening lots and spin-offs
+	OpeningBuy Action = "Opening buy"
+	SpinOffBuy Action = "Spin-off buy"
+)
+
+// ActionKind is how a row is processed
+type ActionKind string
+
+const (
+	BuyKind             ActionKind = "buy"
+	SellKind            ActionKind = "sell"
+	DividendKind        ActionKind = "dividend"
+	ReturnOfCapitalKind ActionKind = "return-of-capital"
+	StockSplitKind      ActionKind = "stock-split"
+	// CorporateActionKind are the rows of a corporate action, they are
+	// skipped as the corporate actions file is what is applied
+	CorporateActionKind ActionKind = "corporate-action"
+	// CashKind are the rows that only move cash, they do not change the
+	// shares held or the gains
+	CashKind    ActionKind = "cash"
+	UnknownKind ActionKind = "unknown"
+)
+
+var actionKinds = map[Action]ActionKind{
+	MarketBuy:          BuyKind,
+	LimitBuy:           BuyKind,
+	StopBuy:            BuyKind,
+	StopLimitBuy:       BuyKind,
+	OpeningBuy:         BuyKind,
+	SpinOffBuy:         BuyKind,
+	MarketSell:         SellKind,
+	LimitSell:          SellKind,
+	StopSell:           SellKind,
+	StopLimitSell:      SellKind,
+	Dividend:           DividendKind,
+	DividendAdjustment: DividendKind,
+	ReturnOfCapital:    ReturnOfCapitalKind,
+	StockSplitOpen:     StockSplitKind,
+	StockSplitClose:    StockSplitKind,
+	Takeover:           CorporateActionKind,
+	SharesRemoval:      CorporateActionKind,
+	NewShares:          CorporateActionKind,
+	TakeoverCash:       CorporateActionKind,
+	Deposit:            CashKind,
+	Withdrawal:         CashKind,
+	InterestOnCash:     CashKind,
+	LendingInterest:    CashKind,
+	CurrencyConversion: CashKind,
+	CardDebit:          CashKind,
+	CardCredit:         CashKind,
+	SpendingCashback:   CashKind,
+}
+
+// legacyActions are the actions of older exports and of the manual
+// transactions that are not in the current exports
+var legacyActions = map[string]Action{
+	"buy":  MarketBuy,
+	"sell": MarketSell,
+}
+
+// dividendIncomeTypes are the types of the "Dividend (...)" rows that are
+// income. Other types, e.g. demerger or tax exempt distributions, may not
+// be income so they are not taken as dividends.
+var dividendIncomeTypes = []string{
+	"ordinary",
+	"dividend",
+	"bonus",
+	"property income",
+	"interest",
+	"dividends paid by us corporations",
+	"dividends paid by foreign corporations",
+}
+
+// ParseAction returns the action of the text in the Action column, ignoring
+// case and spacing
+func ParseAction(value string) (Action, error) {
+	normalised := strings.ToLower(strings.Join(strings.Fields(value), " "))
+	if action, ok := legacyActions[normalised]; ok {
+		return action, nil
+	}
+	for action := range actionKinds {
+		if strings.ToLower(string(action)) == normalised {
+			return action, nil
+		}
+	}
+
+	if strings.HasPrefix(normalised, "dividend (") && strings.HasSuffix(normalised, ")") {
+		dividendType := strings.TrimSuffix(strings.TrimPrefix(normalised, "dividend ("), ")")
+		if slices.Contains(dividendIncomeTypes, dividendType) {
+			return Dividend, nil
+		}
+		return "", merry.Errorf("unknown dividend type '%s', it may not be income, add it to the "+
+			"corporate actions or cost adjustments and remove the row", value)
+	}
+	return "", merry.Errorf("unknown action '%s'", value)
+}
+
+func (a Action) GetKind() ActionKind {
+	kind, ok := actionKinds[a]
+	if !ok {
+		return UnknownKind
+	}
+	return kind
+}
+
+func (a Action) IsBuy() bool {
+	return a.GetKind() == BuyKind
+}
+
+func (a Action) IsSell() bool {
+	return a.GetKind() == SellKind
+}
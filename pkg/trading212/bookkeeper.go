@@ -1,6 +1,10 @@
 package trading212
 
 import (
+	"cmp"
+	"slices"
+	"time"
+
 	"github.com/ansel1/merry/v2"
 	"github.com/go-logr/logr"
 	"github.com/shopspring/decimal"
@@ -12,17 +16,74 @@ type StockSummary struct {
 	ETF     decimal.Decimal
 }
 
+// add sums the Stock and ETF values of both summaries, setting Overall
+func (s StockSummary) add(other StockSummary) StockSummary {
+	summary := StockSummary{
+		Stock: s.Stock.Add(other.Stock),
+		ETF:   s.ETF.Add(other.ETF),
+	}
+	summary.Overall = summary.Stock.Add(summary.ETF)
+	return summary
+}
+
+// ReferenceData is the data from outside the exports that is needed to
+// process the records
+type ReferenceData struct {
+	Prices PriceBook
+	// ExitTaxRates turns on the deemed disposal of fund holdings when set
+	ExitTaxRates     ExitTaxRates
+	Classifications  ClassificationRegistry
+	CorporateActions CorporateActions
+	// CostAdjustments are the manual cost adjustments, in date order
+	CostAdjustments []CostAdjustment
+}
+
 type BookKeeperStruct struct {
-	book map[string]PurchaseHistory
+	// book is keyed by instrument, see getInstrumentKey
+	book          map[string]PurchaseHistory
+	referenceData ReferenceData
+	// unclassified holds the instruments not found in the classification
+	// registry, by ticker
+	unclassified map[string]UnclassifiedInstrument
+	// appliedCorporateActions lists the corporate actions applied to the
+	// records, in the order they were processed
+	appliedCorporateActions []AppliedCorporateAction
+	// isins and tickers map the identifiers seen to the instrument key, the
+	// tickers always point to the latest instrument seen with them
+	isins   map[string]string
+	tickers map[string]string
+	aliases map[string][]InstrumentAlias
+	// tickerCollisions are the new ISINs seen with the ticker of shares held
+	tickerCollisions []TickerCollision
+	// eventsProcessedUntil is the time up to which the corporate actions
+	// acting on the shares held were processed
+	eventsProcessedUntil time.Time
 }
 
 type BookKeeper interface {
-	FindOrCreateEntryAndProcess(log logr.Logger, name string, purchaseHistory Record) error
+	FindOrCreateEntryAndProcess(log logr.Logger, record Record) error
 	Print(log logr.Logger)
 	GetProfitForYear(year int) StockSummary
 	GetSaleAggregatesForYear(year int) StockSummary
 	GetLossAggregatesForYear(year int) StockSummary
 	GetProfitAggregatesForYear(year int) StockSummary
+	GetRestrictedLossAggregatesForYear(year int) StockSummary
+	GetSummaryForPeriod(year int, period Period) PeriodSummary
+	GetDisposalsForYear(year int) []Disposal
+	ProcessDeemedDisposals(log logr.Logger, until time.Time) error
+	ProcessCorporateActions(log logr.Logger, until time.Time) error
+	CheckPendingSplits() error
+	GetCostAdjustments() []CostAdjustment
+	// GetDividends returns the dividends of every share by date
+	GetDividends() []DividendPayment
+	// GetFundDistributions returns the distributions of every fund by date
+	GetFundDistributions() []DividendPayment
+	GetDeemedDisposalsForYear(year int) []DeemedDisposal
+	GetUpcomingDeemedDisposals(after time.Time) []DeemedDisposal
+	GetUnclassifiedInstruments() []UnclassifiedInstrument
+	GetAppliedCorporateActions() []AppliedCorporateAction
+	GetInstruments() []Instrument
+	GetTickerCollisions() []TickerCollision
 }
 
 func (b *BookKeeperStruct) Get(key string) PurchaseHistory {
@@ -30,17 +91,98 @@ func (b *BookKeeperStruct) Get(key string) PurchaseHistory {
 }
 
 func NewBookkeeper() BookKeeper {
-	return &BookKeeperStruct{book: make(map[string]PurchaseHistory)}
+	return NewBookkeeperFromReferenceData(ReferenceData{
+		Prices:           NewPriceBook(),
+		Classifications:  NewClassificationRegistry(),
+		CorporateActions: NewCorporateActions(),
+	})
 }
 
-func (b *BookKeeperStruct) FindOrCreateEntryAndProcess(log logr.Logger, name string, record Record) error {
+func NewBookkeeperFromReferenceData(referenceData ReferenceData) BookKeeper {
+	if referenceData.Prices == nil {
+		referenceData.Prices = NewPriceBook()
+	}
+	if referenceData.Classifications == nil {
+		referenceData.Classifications = NewClassificationRegistry()
+	}
+	if referenceData.CorporateActions == nil {
+		referenceData.CorporateActions = NewCorporateActions()
+	}
+	return &BookKeeperStruct{
+		book:          make(map[string]PurchaseHistory),
+		referenceData: referenceData,
+		unclassified:  make(map[string]UnclassifiedInstrument),
+		isins:         make(map[string]string),
+		tickers:       make(map[string]string),
+		aliases:       make(map[string][]InstrumentAlias),
+	}
+}
+
+// FindOrCreateEntryAndProcess restates the record for the corporate actions
+// after it and processes it in the purchase history of its instrument
+func (b *BookKeeperStruct) FindOrCreateEntryAndProcess(log logr.Logger, record Record) error {
+	if record.Action.GetKind() == CorporateActionKind {
+		// the shares and cash are moved by the corporate actions, the rows
+		// are not counted a second time
+		log.V(1).Info("corporate action row skipped",
+			"action", record.Action,
+			"id", record.ID,
+			"ticker", record.Ticker,
+			"isin", record.Isin,
+			"date", record.Time.Format(time.DateOnly),
+		)
+		return nil
+	}
+
+	if record.IsStockSplit() {
+		action, ok := b.referenceData.CorporateActions.FindSplit(record.Isin, record.Ticker,
+			record.Time, StockSplitConflictWindow)
+		if ok && action.IsBuiltIn() {
+			return merry.Errorf("stock split row '%s' for '%s' on %s is also a built in %s on %s, "+
+				"turn the built in one off with {\"Type\": \"%s\", \"ISIN\": \"%s\", \"Ticker\": \"%s\", "+
+				"\"EffectiveDate\": \"%s\", \"Disabled\": true} in the corporate actions file so the split "+
+				"is not applied twice",
+				record.ID, record.Ticker, record.Time.Format(time.DateOnly), action.Type, action.EffectiveDate,
+				action.Type, action.Isin, action.Ticker, action.EffectiveDate)
+		}
+		if ok {
+			return merry.Errorf("stock split row '%s' for '%s' on %s is also in the corporate actions file "+
+				"as a %s on %s, remove it from the file so the split is not applied twice",
+				record.ID, record.Ticker, record.Time.Format(time.DateOnly), action.Type, action.EffectiveDate)
+		}
+	}
+
+	// mergers before this record happened before it
+	err := b.ProcessCorporateActions(log, record.Time)
+	if err != nil {
+		return merry.Errorf("failed to process corporate actions: %w", err)
+	}
+
+	err = b.applyCorporateActions(log, &record)
+	if err != nil {
+		return merry.Errorf("failed to apply corporate actions: %w", err)
+	}
+
+	// the identifiers are only known once the corporate actions are applied
+	name := b.getInstrumentKey(log, record)
 	_, ok := b.book[name]
 	if !ok {
 		b.book[name] = NewPurchaseHistory(NewRecordQueue())
 	}
 	purchaseHistory := b.book[name]
 
-	err := purchaseHistory.Process(log, &record)
+	b.classify(log, &record)
+
+	if b.referenceData.ExitTaxRates != nil {
+		// anniversaries before this record happened before it
+		err := purchaseHistory.ProcessDeemedDisposals(log, record.Time,
+			b.referenceData.Prices, b.referenceData.ExitTaxRates)
+		if err != nil {
+			return merry.Errorf("failed to process deemed disposals: %w", err)
+		}
+	}
+
+	err = purchaseHistory.Process(log, &record)
 	if err != nil {
 		return merry.Errorf("failed to update purchase history: %w", err)
 	}
@@ -124,3 +266,396 @@ func (b *BookKeeperStruct) GetProfitAggregatesForYear(year int) StockSummary {
 	summary.Overall = summary.Stock.Add(summary.ETF)
 	return summary
 }
+
+// GetRestrictedLossAggregatesForYear returns the losses of the year that were
+// ring-fenced against the reacquired shares instead of being allowable
+func (b *BookKeeperStruct) GetRestrictedLossAggregatesForYear(year int) StockSummary {
+	summary := StockSummary{
+		ETF:   decimal.NewFromInt(0),
+		Stock: decimal.NewFromInt(0),
+	}
+	for _, ph := range b.book {
+		yearlySummary := ph.GetRestrictedLossAggregatesForYear(year)
+		summary.ETF = summary.ETF.Add(yearlySummary.ETF)
+		summary.Stock = summary.Stock.Add(yearlySummary.Stock)
+	}
+	summary.Overall = summary.Stock.Add(summary.ETF)
+	return summary
+}
+
+// GetSummaryForPeriod returns every summary for a single payment period of the
+// year, summed across all instruments
+func (b *BookKeeperStruct) GetSummaryForPeriod(year int, period Period) PeriodSummary {
+	summary := PeriodSummary{}
+	for _, ph := range b.book {
+		periodSummary := ph.GetSummaryForPeriod(year, period)
+		summary.Profits = summary.Profits.add(periodSummary.Profits)
+		summary.SaleAggregates = summary.SaleAggregates.add(periodSummary.SaleAggregates)
+		summary.LossAggregates = summary.LossAggregates.add(periodSummary.LossAggregates)
+		summary.ProfitAggregates = summary.ProfitAggregates.add(periodSummary.ProfitAggregates)
+		summary.RestrictedLossAggregates = summary.RestrictedLossAggregates.add(periodSummary.RestrictedLossAggregates)
+	}
+	return summary
+}
+
+// GetDisposalsForYear returns the disposals of every instrument in the year,
+// ordered by the date of the sale
+func (b *BookKeeperStruct) GetDisposalsForYear(year int) []Disposal {
+	disposals := []Disposal{}
+	for _, ph := range b.book {
+		disposals = append(disposals, ph.GetDisposalsForYear(year)...)
+	}
+	slices.SortStableFunc(disposals, func(first, second Disposal) int {
+		return cmp.Or(first.Date.Compare(second.Date),
+			cmp.Compare(first.Ticker, second.Ticker))
+	})
+	return disposals
+}
+
+// ProcessDeemedDisposals processes the anniversaries of every open fund lot up
+// to the given time
+func (b *BookKeeperStruct) ProcessDeemedDisposals(log logr.Logger, until time.Time) error {
+	if b.referenceData.ExitTaxRates == nil {
+		return nil
+	}
+	for name, ph := range b.book {
+		err := ph.ProcessDeemedDisposals(log, until, b.referenceData.Prices, b.referenceData.ExitTaxRates)
+		if err != nil {
+			return merry.Errorf("failed to process deemed disposals for '%s': %w", name, err)
+		}
+	}
+	return nil
+}
+
+func (b *BookKeeperStruct) GetDeemedDisposalsForYear(year int) []DeemedDisposal {
+	deemedDisposals := []DeemedDisposal{}
+	for _, ph := range b.book {
+		deemedDisposals = append(deemedDisposals, ph.GetDeemedDisposalsForYear(year)...)
+	}
+	slices.SortStableFunc(deemedDisposals, func(first, second DeemedDisposal) int {
+		return cmp.Or(first.Date.Compare(second.Date),
+			cmp.Compare(first.Ticker, second.Ticker))
+	})
+	return deemedDisposals
+}
+
+// GetUpcomingDeemedDisposals lists the next anniversary of every open fund lot,
+// soonest first
+func (b *BookKeeperStruct) GetUpcomingDeemedDisposals(after time.Time) []DeemedDisposal {
+	upcoming := []DeemedDisposal{}
+	for _, ph := range b.book {
+		upcoming = append(upcoming, ph.GetUpcomingDeemedDisposals(after, b.referenceData.Prices)...)
+	}
+	slices.SortStableFunc(upcoming, func(first, second DeemedDisposal) int {
+		return cmp.Or(first.Date.Compare(second.Date),
+			cmp.Compare(first.Ticker, second.Ticker))
+	})
+	return upcoming
+}
+
+// classify sets the asset class of the record, keeping track of the
+// instruments that are not in the registry
+func (b *BookKeeperStruct) classify(log logr.Logger, record *Record) {
+	if record.Isin == "" && record.Ticker == "" {
+		// not an instrument, e.g. a deposit
+		return
+	}
+
+	classification := b.referenceData.Classifications.Classify(record.Isin, record.Ticker, record.Name)
+	record.AssetClass = classification.Class
+
+	if classification.Status == Classified {
+		return
+	}
+	if _, ok := b.unclassified[record.Ticker]; ok {
+		return
+	}
+	b.unclassified[record.Ticker] = UnclassifiedInstrument{
+		Isin:   record.Isin,
+		Ticker: record.Ticker,
+		Name:   record.Name,
+		Class:  classification.Class,
+		Status: classification.Status,
+	}
+	message := "WARNING: instrument is not in the classification registry"
+	if classification.Status == NeedsReview && classification.Class != UCITSFundClass {
+		message = "WARNING: fund that is not a UCITS fund is processed under CGT, check how it is taxed"
+	}
+	log.V(0).Info(message,
+		"ticker", record.Ticker, "isin", record.Isin, "name", record.Name,
+		"processedAs", classification.Class, "status", classification.Status)
+}
+
+func (b *BookKeeperStruct) GetUnclassifiedInstruments() []UnclassifiedInstrument {
+	instruments := []UnclassifiedInstrument{}
+	for _, instrument := range b.unclassified {
+		instruments = append(instruments, instrument)
+	}
+	slices.SortFunc(instruments, func(first, second UnclassifiedInstrument) int {
+		return cmp.Compare(first.Ticker, second.Ticker)
+	})
+	return instruments
+}
+
+// applyCorporateActions restates the record to the terms in force after all
+// the corporate actions that followed it
+func (b *BookKeeperStruct) applyCorporateActions(log logr.Logger, record *Record) error {
+	for _, action := range b.referenceData.CorporateActions.GetActionsFor(*record) {
+		applied := AppliedCorporateAction{
+			Action:         action,
+			RecordID:       record.ID,
+			RecordAction:   record.Action,
+			RecordTime:     record.Time,
+			Ticker:         record.Ticker,
+			Isin:           record.Isin,
+			QuantityBefore: record.NoOfShares,
+		}
+
+		err := record.ApplyCorporateAction(action)
+		if err != nil {
+			return merry.Errorf("failed to apply %s on %s to '%s': %w",
+				action.Type, action.EffectiveDate, record.ID, err)
+		}
+		applied.QuantityAfter = record.NoOfShares
+		b.appliedCorporateActions = append(b.appliedCorporateActions, applied)
+
+		log.V(1).Info("corporate action applied",
+			"type", action.Type,
+			"effectiveDate", action.EffectiveDate,
+			"id", record.ID,
+			"ticker", applied.Ticker,
+			"quantityBefore", applied.QuantityBefore,
+			"quantityAfter", applied.QuantityAfter,
+		)
+	}
+	return nil
+}
+
+func (b *BookKeeperStruct) GetAppliedCorporateActions() []AppliedCorporateAction {
+	return b.appliedCorporateActions
+}
+
+// ProcessCorporateActions applies the corporate actions and the manual cost
+// adjustments that act on the shares held, e.g. mergers, up to the given time
+func (b *BookKeeperStruct) ProcessCorporateActions(log logr.Logger, until time.Time) error {
+	events := b.referenceData.CorporateActions.GetEvents(b.eventsProcessedUntil, until)
+	adjustments := []CostAdjustment{}
+	for _, adjustment := range b.referenceData.CostAdjustments {
+		if adjustment.Date.After(b.eventsProcessedUntil) && !adjustment.Date.After(until) {
+			adjustments = append(adjustments, adjustment)
+		}
+	}
+
+	for len(events) > 0 || len(adjustments) > 0 {
+		if len(adjustments) > 0 &&
+			(len(events) == 0 || adjustments[0].Date.Before(events[0].GetEffectiveDate())) {
+			err := b.processCostAdjustment(log, adjustments[0])
+			if err != nil {
+				return merry.Errorf("failed to process cost adjustment on %s: %w",
+					adjustments[0].Date.Format(time.DateOnly), err)
+			}
+			adjustments = adjustments[1:]
+			continue
+		}
+
+		action := events[0]
+		events = events[1:]
+
+		var err error
+		switch action.Type {
+		case Merger:
+			err = b.processMerger(log, action)
+		case SpinOff:
+			err = b.processSpinOff(log, action)
+		}
+		if err != nil {
+			return merry.Errorf("failed to process %s on %s: %w", action.Type, action.EffectiveDate, err)
+		}
+	}
+
+	if until.After(b.eventsProcessedUntil) {
+		b.eventsProcessedUntil = until
+	}
+	return nil
+}
+
+// getHeldInstrument returns the purchase history of the instrument, brought
+// up to the date, if any shares are held
+func (b *BookKeeperStruct) getHeldInstrument(log logr.Logger, isin, ticker string,
+	date time.Time) (PurchaseHistory, bool, error) {
+	key, ok := b.findInstrumentKey(isin, ticker)
+	if !ok || b.book[key].GetRecordQueue().IsEmpty() {
+		log.V(1).Info("event for an instrument not held",
+			"ticker", ticker, "isin", isin, "date", date.Format(time.DateOnly))
+		return nil, false, nil
+	}
+	purchaseHistory := b.book[key]
+
+	if b.referenceData.ExitTaxRates != nil {
+		err := purchaseHistory.ProcessDeemedDisposals(log, date,
+			b.referenceData.Prices, b.referenceData.ExitTaxRates)
+		if err != nil {
+			return nil, false, merry.Errorf("failed to process deemed disposals: %w", err)
+		}
+	}
+	return purchaseHistory, true, nil
+}
+
+// addLots adds the lots to the purchase history of the new instrument of the
+// action
+func (b *BookKeeperStruct) addLots(log logr.Logger, action CorporateAction, lots []*Record) {
+	if len(lots) == 0 {
+		return
+	}
+
+	key := b.getInstrumentKey(log, Record{
+		ID:     lots[0].ID,
+		Time:   action.GetEffectiveDate(),
+		Isin:   action.NewIsin,
+		Ticker: action.NewTicker,
+	})
+	_, ok := b.book[key]
+	if !ok {
+		b.book[key] = NewPurchaseHistory(NewRecordQueue())
+	}
+	for _, lot := range lots {
+		b.classify(log, lot)
+		b.book[key].GetRecordQueue().Append(lot)
+	}
+}
+
+// processMerger moves the lots of the instrument taken over to the new
+// instrument, the cash part is disposed of in the old one
+func (b *BookKeeperStruct) processMerger(log logr.Logger, action CorporateAction) error {
+	purchaseHistory, ok, err := b.getHeldInstrument(log, action.Isin, action.Ticker,
+		action.GetEffectiveDate())
+	if err != nil || !ok {
+		return err
+	}
+
+	newSharePrice := action.NewSharePrice
+	if action.To.IsPositive() && action.CashPerShare.IsPositive() && newSharePrice.IsZero() {
+		var priceDate time.Time
+		newSharePrice, priceDate, ok = getRecentPrice(b.referenceData.Prices, action.NewIsin, action.NewTicker,
+			action.GetEffectiveDate())
+		if !ok {
+			return merry.Errorf("no NewSharePrice or recent price for '%s' to apportion the cost between "+
+				"the cash and the new shares, latest price: %s", cmp.Or(action.NewIsin, action.NewTicker),
+				formatPriceDate(priceDate))
+		}
+	}
+
+	lots := slices.Clone(purchaseHistory.GetRecordQueue().GetQueue())
+	applied := newAppliedCorporateActions(action, lots)
+
+	moved, err := purchaseHistory.ProcessMerger(log, action, newSharePrice)
+	if err != nil {
+		return merry.Errorf("failed to process merger: %w", err)
+	}
+	for _, lot := range moved {
+		applied[slices.Index(lots, lot)].QuantityAfter = lot.NoOfShares
+	}
+	b.addLots(log, action, moved)
+
+	b.appliedCorporateActions = append(b.appliedCorporateActions, applied...)
+	return nil
+}
+
+// processSpinOff adds the lots of the shares spun off to the new instrument
+func (b *BookKeeperStruct) processSpinOff(log logr.Logger, action CorporateAction) error {
+	purchaseHistory, ok, err := b.getHeldInstrument(log, action.Isin, action.Ticker,
+		action.GetEffectiveDate())
+	if err != nil || !ok {
+		return err
+	}
+
+	applied := newAppliedCorporateActions(action, purchaseHistory.GetRecordQueue().GetQueue())
+	for i := range applied {
+		// the shares held do not change
+		applied[i].QuantityAfter = applied[i].QuantityBefore
+	}
+
+	b.addLots(log, action, purchaseHistory.ProcessSpinOff(log, action))
+
+	b.appliedCorporateActions = append(b.appliedCorporateActions, applied...)
+	return nil
+}
+
+// processCostAdjustment takes a manual cost adjustment off the lots held
+func (b *BookKeeperStruct) processCostAdjustment(log logr.Logger, adjustment CostAdjustment) error {
+	purchaseHistory, ok, err := b.getHeldInstrument(log, adjustment.Isin, adjustment.Ticker, adjustment.Date)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		log.V(0).Info("WARNING: cost adjustment for shares not held, it is ignored",
+			"ticker", adjustment.Ticker, "isin", adjustment.Isin,
+			"date", adjustment.Date.Format(time.DateOnly), "amount", adjustment.Amount)
+		return nil
+	}
+	return purchaseHistory.AdjustCost(log, adjustment)
+}
+
+// newAppliedCorporateActions returns an entry for every lot the action is
+// applied to, with nothing left after it
+func newAppliedCorporateActions(action CorporateAction, lots []*Record) []AppliedCorporateAction {
+	applied := []AppliedCorporateAction{}
+	for _, lot := range lots {
+		applied = append(applied, AppliedCorporateAction{
+			Action:         action,
+			RecordID:       lot.ID,
+			RecordAction:   lot.Action,
+			RecordTime:     lot.Time,
+			Ticker:         lot.Ticker,
+			Isin:           lot.Isin,
+			QuantityBefore: lot.NoOfShares,
+			QuantityAfter:  decimal.NewFromInt(0),
+		})
+	}
+	return applied
+}
+
+// findInstrumentKey returns the key of the instrument known by the ISIN, or
+// by the ticker
+func (b *BookKeeperStruct) findInstrumentKey(isin, ticker string) (string, bool) {
+	if key, ok := b.isins[isin]; ok && isin != "" {
+		return key, true
+	}
+	key, ok := b.tickers[ticker]
+	return key, ok && ticker != ""
+}
+
+func (b *BookKeeperStruct) GetCostAdjustments() []CostAdjustment {
+	adjustments := []CostAdjustment{}
+	for _, ph := range b.book {
+		adjustments = append(adjustments, ph.GetCostAdjustments()...)
+	}
+	slices.SortFunc(adjustments, func(first, second CostAdjustment) int {
+		return cmp.Or(first.Date.Compare(second.Date), cmp.Compare(first.Ticker, second.Ticker))
+	})
+	return adjustments
+}
+
+func (b *BookKeeperStruct) GetDividends() []DividendPayment {
+	dividends := []DividendPayment{}
+	for _, ph := range b.book {
+		dividends = append(dividends, ph.GetDividends()...)
+	}
+	sortDividends(dividends)
+	return dividends
+}
+
+func (b *BookKeeperStruct) GetFundDistributions() []DividendPayment {
+	distributions := []DividendPayment{}
+	for _, ph := range b.book {
+		distributions = append(distributions, ph.GetFundDistributions()...)
+	}
+	sortDividends(distributions)
+	return distributions
+}
+
+func sortDividends(dividends []DividendPayment) {
+	slices.SortFunc(dividends, func(first, second DividendPayment) int {
+		return cmp.Or(first.Date.Compare(second.Date), cmp.Compare(first.Ticker, second.Ticker))
+	})
+}
@@ -0,0 +1,190 @@
+package trading212
+
+import (
+	"cmp"
+	"encoding/json"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/ansel1/merry/v2"
+)
+
+type AssetClass string
+
+const (
+	StockClass AssetClass = "stock"
+	// UCITSFundClass is an EU-domiciled UCITS fund, taxed under the exit tax
+	// regime
+	UCITSFundClass       AssetClass = "ucits-fund"
+	USETFClass           AssetClass = "us-etf"
+	InvestmentTrustClass AssetClass = "investment-trust"
+	ETCClass             AssetClass = "etc"
+	BondClass            AssetClass = "bond"
+)
+
+var AssetClasses = []AssetClass{
+	StockClass,
+	UCITSFundClass,
+	USETFClass,
+	InvestmentTrustClass,
+	ETCClass,
+	BondClass,
+}
+
+// cgtReviewClasses are the funds and fund-like products outside the UCITS
+// exit tax regime. They are processed under CGT, but can be taxed otherwise
+// (e.g. as offshore funds), so they always need review.
+var cgtReviewClasses = []AssetClass{USETFClass, InvestmentTrustClass, ETCClass}
+
+// GetRecordType returns how the asset class is summarised, only UCITS funds
+// are kept apart from the CGT figures
+func (c AssetClass) GetRecordType() RecordType {
+	if c == UCITSFundClass {
+		return ETF
+	}
+	return Stock
+}
+
+// ClassificationFileEntry maps an instrument to its asset class, by ISIN
+// and/or ticker
+type ClassificationFileEntry struct {
+	Isin   string     `json:"ISIN"`
+	Ticker string     `json:"Ticker"`
+	Class  AssetClass `json:"Class"`
+}
+
+type ClassificationFile struct {
+	Classifications []ClassificationFileEntry `json:"classifications"`
+}
+
+type ClassificationStatus string
+
+const (
+	Classified ClassificationStatus = "classified"
+	// NeedsReview is an instrument that looks like a fund but is not in the
+	// registry, or is in it as a fund that is not a UCITS fund
+	NeedsReview ClassificationStatus = "needs-review"
+	Unknown     ClassificationStatus = "unknown"
+)
+
+type Classification struct {
+	Class  AssetClass
+	Status ClassificationStatus
+}
+
+type ClassificationRegistry interface {
+	// Classify looks the instrument up by ISIN and then by ticker, falling
+	// back to the default rules
+	Classify(isin, ticker, name string) Classification
+}
+
+type ClassificationRegistryStruct struct {
+	classes map[string]AssetClass
+}
+
+// defaultClassifications are the instruments known before the registry
+// was added
+var defaultClassifications = []ClassificationFileEntry{
+	{Isin: "IE00B3XXRP09", Ticker: "VUSA", Class: UCITSFundClass},
+	{Isin: "IE00BFMXXD54", Ticker: "VUAA", Class: UCITSFundClass},
+}
+
+// fundLikeNames are the words in an instrument name that suggest a fund
+var fundLikeNames = []string{"ETF", "UCITS", "FUND", "INDEX", "ISHARES", "VANGUARD", "SPDR", "XTRACKERS", "AMUNDI"}
+
+func NewClassificationRegistry() ClassificationRegistry {
+	registry := &ClassificationRegistryStruct{classes: make(map[string]AssetClass)}
+	registry.add(defaultClassifications)
+	return registry
+}
+
+// LoadClassificationRegistry reads the classification file at the given
+// path, its entries take precedence over the defaults
+func LoadClassificationRegistry(filePath string) (ClassificationRegistry, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, merry.Errorf("failed to open classification file: %w", err)
+	}
+	defer file.Close()
+
+	classificationFile := ClassificationFile{}
+	err = json.NewDecoder(file).Decode(&classificationFile)
+	if err != nil {
+		return nil, merry.Errorf("failed to parse classification file: %w", err)
+	}
+
+	for _, entry := range classificationFile.Classifications {
+		if !slices.Contains(AssetClasses, entry.Class) {
+			return nil, merry.Errorf("unknown asset class '%s' for '%s'", entry.Class,
+				cmp.Or(entry.Isin, entry.Ticker))
+		}
+		if entry.Isin == "" && entry.Ticker == "" {
+			return nil, merry.Errorf("classification for '%s' has no ISIN or ticker", entry.Class)
+		}
+	}
+
+	registry := &ClassificationRegistryStruct{classes: make(map[string]AssetClass)}
+	registry.add(defaultClassifications)
+	registry.add(classificationFile.Classifications)
+	return registry, nil
+}
+
+func (r *ClassificationRegistryStruct) add(entries []ClassificationFileEntry) {
+	for _, entry := range entries {
+		for _, key := range []string{entry.Isin, entry.Ticker} {
+			if key == "" {
+				continue
+			}
+			r.classes[key] = entry.Class
+		}
+	}
+}
+
+func (r *ClassificationRegistryStruct) Classify(isin, ticker, name string) Classification {
+	for _, key := range []string{isin, ticker} {
+		if key == "" {
+			continue
+		}
+		if class, ok := r.classes[key]; ok {
+			if slices.Contains(cgtReviewClasses, class) {
+				return Classification{Class: class, Status: NeedsReview}
+			}
+			return Classification{Class: class, Status: Classified}
+		}
+	}
+
+	if looksLikeFund(name) {
+		switch {
+		case strings.HasPrefix(isin, "IE") || strings.HasPrefix(isin, "LU"):
+			return Classification{Class: UCITSFundClass, Status: NeedsReview}
+		case strings.HasPrefix(isin, "US"):
+			return Classification{Class: USETFClass, Status: NeedsReview}
+		default:
+			return Classification{Class: StockClass, Status: NeedsReview}
+		}
+	}
+	return Classification{Class: StockClass, Status: Unknown}
+}
+
+// looksLikeFund is true for an instrument with a fund-like name
+func looksLikeFund(name string) bool {
+	upperName := strings.ToUpper(name)
+	for _, word := range fundLikeNames {
+		if strings.Contains(upperName, word) {
+			return true
+		}
+	}
+	return false
+}
+
+// UnclassifiedInstrument is an instrument that is not in the registry, or
+// whose class needs its tax treatment reviewed
+type UnclassifiedInstrument struct {
+	Isin   string
+	Ticker string
+	Name   string
+	// Class is the asset class it was processed as
+	Class  AssetClass
+	Status ClassificationStatus
+}
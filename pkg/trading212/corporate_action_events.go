@@ -0,0 +1,138 @@
+package trading212
+
+import (
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/shopspring/decimal"
+)
+
+// ProcessMerger takes the open lots out of the history for a merger. The cash
+// received is a part disposal of every lot, with the cost apportioned by the
+// value of the cash and of the new shares. The rest of the cost and the
+// acquisition dates carry over to the new shares, which are returned.
+func (q *PurchaseHistoryStruct) ProcessMerger(log logr.Logger, action CorporateAction,
+	newSharePrice decimal.Decimal) ([]*Record, error) {
+	lots := slices.Clone(q.recordQueue.GetQueue())
+	if len(lots) == 0 {
+		return []*Record{}, nil
+	}
+
+	// the value received for every From shares held
+	cashValue := action.CashPerShare.Mul(action.From)
+	sharesValue := action.To.Mul(newSharePrice)
+	cashShare := cashValue.Div(cashValue.Add(sharesValue))
+	ratio := action.To.Div(action.From)
+
+	var disposal *Disposal
+	if cashValue.IsPositive() {
+		disposal = &Disposal{
+			ID:           fmt.Sprintf("%s-%s", action.Type, action.EffectiveDate),
+			Date:         action.GetEffectiveDate(),
+			Isin:         lots[0].Isin,
+			Ticker:       lots[0].Ticker,
+			Name:         lots[0].Name,
+			Type:         lots[0].GetType(),
+			ExchangeRate: decimal.NewFromInt(1),
+			Lots:         []DisposalLot{},
+		}
+	}
+
+	moved := []*Record{}
+	for _, lot := range lots {
+		q.recordQueue.RemoveItem(lot)
+
+		if disposal != nil {
+			disposal.Quantity = disposal.Quantity.Add(lot.NoOfShares)
+			disposal.AddLot(DisposalLot{
+				BuyID:        lot.ID,
+				BuyDate:      lot.Time,
+				Quantity:     lot.NoOfShares,
+				Cost:         lot.GetCost().Mul(cashShare),
+				Proceeds:     action.CashPerShare.Mul(lot.NoOfShares),
+				BuyFees:      lot.CurrencyConversionFee.Mul(cashShare),
+				SellFees:     decimal.NewFromInt(0),
+				ExchangeRate: lot.ExchangeRate,
+				Method:       CorporateActionMatch,
+				DeemedDisposalCredit: lot.DeemedDisposalTaxPerShare.Mul(lot.NoOfShares).
+					Mul(cashShare),
+			})
+		}
+
+		if ratio.IsZero() {
+			// cash only, nothing carries over
+			continue
+		}
+
+		remaining := decimal.NewFromInt(1).Sub(cashShare)
+		lot.ScaleCost(remaining)
+		lot.DeemedDisposalTaxPerShare = lot.DeemedDisposalTaxPerShare.Mul(remaining)
+		lot.Rescale(ratio)
+		lot.Isin = action.NewIsin
+		lot.Ticker = action.NewTicker
+		moved = append(moved, lot)
+	}
+
+	if disposal != nil {
+		err := q.recordDisposal(disposal)
+		if err != nil {
+			return nil, err
+		}
+
+		log.V(1).Info("merger cash",
+			"ticker", disposal.Ticker,
+			"date", disposal.Date.String(),
+			"proceeds", disposal.Proceeds.String(),
+			"cost", disposal.Cost.String(),
+			"profit", disposal.Profit.String())
+	}
+	return moved, nil
+}
+
+// ProcessSpinOff creates the lots of the shares spun off from the open lots.
+// They take the CostFraction of the cost of the lots they come from and keep
+// their acquisition dates, the cost of the open lots is reduced to match.
+func (q *PurchaseHistoryStruct) ProcessSpinOff(log logr.Logger, action CorporateAction) []*Record {
+	ratio := action.To.Div(action.From)
+	remaining := decimal.NewFromInt(1).Sub(action.CostFraction)
+
+	spunOff := []*Record{}
+	for _, lot := range q.recordQueue.GetQueue() {
+		quantity := lot.NoOfShares.Mul(ratio)
+		cost := lot.GetCost().Mul(action.CostFraction)
+		deemedDisposalTax := lot.DeemedDisposalTaxPerShare.Mul(lot.NoOfShares).Mul(action.CostFraction)
+
+		newLot := &Record{
+			Action:                        SpinOffBuy,
+			Time:                          lot.Time,
+			Isin:                          action.NewIsin,
+			Ticker:                        action.NewTicker,
+			Name:                          action.NewTicker,
+			NoOfShares:                    quantity,
+			PriceShare:                    cost.Div(quantity),
+			CurrencyPriceShare:            "EUR",
+			ExchangeRate:                  decimal.NewFromInt(1),
+			Total:                         cost,
+			CurrencyTotal:                 "EUR",
+			Notes:                         fmt.Sprintf("%s of %s on %s", action.Type, lot.Ticker, action.EffectiveDate),
+			ID:                            fmt.Sprintf("%s-%s", lot.ID, action.Type),
+			CurrencyCurrencyConversionFee: "EUR",
+			DeemedDisposalCount:           lot.DeemedDisposalCount,
+			DeemedDisposalTaxPerShare:     deemedDisposalTax.Div(quantity),
+		}
+
+		lot.ScaleCost(remaining)
+		lot.DeemedDisposalTaxPerShare = lot.DeemedDisposalTaxPerShare.Mul(remaining)
+		spunOff = append(spunOff, newLot)
+
+		log.V(1).Info("spin-off",
+			"ticker", lot.Ticker,
+			"newTicker", newLot.Ticker,
+			"acquired", lot.Time.Format(time.DateOnly),
+			"quantity", quantity.String(),
+			"cost", cost.String())
+	}
+	return spunOff
+}
@@ -0,0 +1,329 @@
+package trading212
+
+import (
+	"cmp"
+	_ "embed"
+	"encoding/json"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/ansel1/merry/v2"
+	"github.com/shopspring/decimal"
+)
+
+// CorporateActionsFileVersion is the version of the file format supported
+const CorporateActionsFileVersion = 1
+
+//go:embed data/corporate-actions.json
+var defaultCorporateActions []byte
+
+type CorporateActionType string
+
+const (
+	ForwardSplit CorporateActionType = "forward-split"
+	ReverseSplit CorporateActionType = "reverse-split"
+	TickerChange CorporateActionType = "ticker-change"
+	IsinChange   CorporateActionType = "isin-change"
+	// Merger replaces the shares held with shares of another instrument
+	// and/or cash on the effective date
+	Merger CorporateActionType = "merger"
+	// SpinOff gives shares of a new instrument on top of the shares held,
+	// taking part of their cost
+	SpinOff CorporateActionType = "spin-off"
+)
+
+// CorporateAction is an event that changes how the records before it are to
+// be read. Records are restated to the terms in force after the action.
+type CorporateAction struct {
+	Type CorporateActionType `json:"Type"`
+	// ISIN and Ticker identify the instrument before the action, the ISIN is
+	// used when both the action and the record have one
+	Isin          string `json:"ISIN"`
+	Ticker        string `json:"Ticker"`
+	EffectiveDate string `json:"EffectiveDate"`
+
+	// From and To are the split or exchange ratio, To shares for every From
+	// held
+	From decimal.Decimal `json:"From"`
+	To   decimal.Decimal `json:"To"`
+
+	NewTicker string `json:"NewTicker"`
+	NewIsin   string `json:"NewISIN"`
+
+	// CashPerShare is the cash in EUR received for every share held
+	CashPerShare decimal.Decimal `json:"CashPerShare"`
+	// NewSharePrice is the EUR value of a new share on the effective date,
+	// used to apportion the cost between the cash and the new shares. The
+	// prices file is used when it is not set.
+	NewSharePrice decimal.Decimal `json:"NewSharePrice"`
+	// CostFraction is the part of the cost of the shares held that goes to
+	// the shares spun off, normally from the first day market values
+	CostFraction decimal.Decimal `json:"CostFraction"`
+
+	Notes string `json:"Notes"`
+
+	// Disabled turns off the built in action of the same type, instrument
+	// and effective date, e.g. when the export has the split rows
+	Disabled bool `json:"Disabled"`
+
+	effectiveDate time.Time
+	builtIn       bool
+}
+
+type CorporateActionsFile struct {
+	Version int               `json:"version"`
+	Actions []CorporateAction `json:"actions"`
+}
+
+// AppliedCorporateAction records an action applied to a record
+type AppliedCorporateAction struct {
+	Action   CorporateAction
+	RecordID string
+	// RecordAction is the action of the record, e.g. buy or sell
+	RecordAction Action
+	RecordTime   time.Time
+	// Ticker and Isin are the identifiers of the record before the action
+	Ticker         string
+	Isin           string
+	QuantityBefore decimal.Decimal
+	QuantityAfter  decimal.Decimal
+}
+
+type CorporateActions interface {
+	// GetActionsFor returns the actions effective after the record, in the
+	// order they happened, following ticker and ISIN changes
+	GetActionsFor(record Record) []CorporateAction
+	// FindSplit returns a split of the instrument effective within the window
+	// either side of the date
+	FindSplit(isin, ticker string, date time.Time, window time.Duration) (CorporateAction, bool)
+	// GetEvents returns the actions that act on the shares held, effective
+	// after the from time up to and including the until time
+	GetEvents(from, until time.Time) []CorporateAction
+}
+
+type CorporateActionsStruct struct {
+	actions []CorporateAction
+}
+
+// NewCorporateActions returns the built in corporate actions, it panics if
+// the built in file is invalid
+func NewCorporateActions() CorporateActions {
+	actionsFile, err := parseDefaultCorporateActions()
+	if err != nil {
+		panic(merry.Errorf("failed to parse built in corporate actions: %w", err))
+	}
+	return newCorporateActionsStruct(actionsFile.Actions)
+}
+
+// parseDefaultCorporateActions returns the built in corporate actions
+func parseDefaultCorporateActions() (CorporateActionsFile, error) {
+	actionsFile, err := parseCorporateActions(defaultCorporateActions)
+	if err != nil {
+		return actionsFile, err
+	}
+	for i := range actionsFile.Actions {
+		actionsFile.Actions[i].builtIn = true
+	}
+	return actionsFile, nil
+}
+
+// LoadCorporateActions reads the corporate actions file at the given path,
+// adding its actions to the built in ones and removing the built in ones it
+// disables
+func LoadCorporateActions(filePath string) (CorporateActions, error) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, merry.Errorf("failed to read corporate actions file: %w", err)
+	}
+	actionsFile, err := parseCorporateActions(data)
+	if err != nil {
+		return nil, merry.Errorf("failed to parse corporate actions file: %w", err)
+	}
+
+	defaults, err := parseDefaultCorporateActions()
+	if err != nil {
+		return nil, merry.Errorf("failed to parse built in corporate actions: %w", err)
+	}
+
+	actions := []CorporateAction{}
+	for _, action := range actionsFile.Actions {
+		if !action.Disabled {
+			actions = append(actions, action)
+			continue
+		}
+
+		i := slices.IndexFunc(defaults.Actions, func(builtIn CorporateAction) bool {
+			return builtIn.Type == action.Type && builtIn.EffectiveDate == action.EffectiveDate &&
+				builtIn.appliesTo(action.Isin, action.Ticker)
+		})
+		if i < 0 {
+			return nil, merry.Errorf("disabled %s of '%s' on %s is not a built in corporate action",
+				action.Type, cmp.Or(action.Isin, action.Ticker), action.EffectiveDate)
+		}
+		defaults.Actions = slices.Delete(defaults.Actions, i, i+1)
+	}
+	return newCorporateActionsStruct(append(defaults.Actions, actions...)), nil
+}
+
+func newCorporateActionsStruct(actions []CorporateAction) *CorporateActionsStruct {
+	slices.SortStableFunc(actions, func(first, second CorporateAction) int {
+		return first.effectiveDate.Compare(second.effectiveDate)
+	})
+	return &CorporateActionsStruct{actions: actions}
+}
+
+func parseCorporateActions(data []byte) (CorporateActionsFile, error) {
+	actionsFile := CorporateActionsFile{}
+	err := json.Unmarshal(data, &actionsFile)
+	if err != nil {
+		return actionsFile, merry.Errorf("failed to unmarshal corporate actions: %w", err)
+	}
+
+	if actionsFile.Version != CorporateActionsFileVersion {
+		return actionsFile, merry.Errorf("unsupported corporate actions file version: %d", actionsFile.Version)
+	}
+
+	for i := range actionsFile.Actions {
+		err = actionsFile.Actions[i].validate()
+		if err != nil {
+			return actionsFile, merry.Errorf("invalid corporate action %d: %w", i, err)
+		}
+	}
+	return actionsFile, nil
+}
+
+func (a *CorporateAction) validate() error {
+	effectiveDate, err := time.Parse(time.DateOnly, a.EffectiveDate)
+	if err != nil {
+		return merry.Errorf("failed to parse effective date '%s': %w", a.EffectiveDate, err)
+	}
+	a.effectiveDate = effectiveDate
+
+	if a.Isin == "" && a.Ticker == "" {
+		return merry.Errorf("%s on %s has no ISIN or ticker", a.Type, a.EffectiveDate)
+	}
+	if a.Disabled {
+		// only the type, instrument and date are needed to find the built
+		// in action
+		return nil
+	}
+
+	switch a.Type {
+	case ForwardSplit, ReverseSplit:
+		if !a.From.IsPositive() || !a.To.IsPositive() {
+			return merry.Errorf("%s on %s needs a positive From and To", a.Type, a.EffectiveDate)
+		}
+		if a.Type == ForwardSplit && !a.To.GreaterThan(a.From) {
+			return merry.Errorf("forward split on %s must give more shares than held", a.EffectiveDate)
+		}
+		if a.Type == ReverseSplit && !a.To.LessThan(a.From) {
+			return merry.Errorf("reverse split on %s must give fewer shares than held", a.EffectiveDate)
+		}
+	case TickerChange:
+		if a.NewTicker == "" {
+			return merry.Errorf("ticker change on %s has no new ticker", a.EffectiveDate)
+		}
+	case IsinChange:
+		if a.NewIsin == "" {
+			return merry.Errorf("ISIN change on %s has no new ISIN", a.EffectiveDate)
+		}
+	case Merger:
+		if !a.From.IsPositive() || a.To.IsNegative() || a.CashPerShare.IsNegative() {
+			return merry.Errorf("merger on %s needs a positive From, and To and CashPerShare "+
+				"can not be negative", a.EffectiveDate)
+		}
+		if a.To.IsZero() && a.CashPerShare.IsZero() {
+			return merry.Errorf("merger on %s gives neither shares nor cash", a.EffectiveDate)
+		}
+		if a.To.IsPositive() && a.NewIsin == "" && a.NewTicker == "" {
+			return merry.Errorf("merger on %s has no new ISIN or ticker", a.EffectiveDate)
+		}
+	case SpinOff:
+		if !a.From.IsPositive() || !a.To.IsPositive() {
+			return merry.Errorf("spin-off on %s needs a positive From and To", a.EffectiveDate)
+		}
+		if !a.CostFraction.IsPositive() || !a.CostFraction.LessThan(decimal.NewFromInt(1)) {
+			return merry.Errorf("spin-off on %s needs a CostFraction between 0 and 1", a.EffectiveDate)
+		}
+		if a.NewIsin == "" && a.NewTicker == "" {
+			return merry.Errorf("spin-off on %s has no new ISIN or ticker", a.EffectiveDate)
+		}
+	default:
+		return merry.Errorf("unknown corporate action type '%s'", a.Type)
+	}
+	return nil
+}
+
+// GetEffectiveDate returns the date from which the action is in force,
+// records before it are restated
+func (a *CorporateAction) GetEffectiveDate() time.Time {
+	return a.effectiveDate
+}
+
+// IsEvent is true for the actions that act on the shares held when they
+// happen, rather than restating the records before them
+func (a *CorporateAction) IsEvent() bool {
+	return a.Type == Merger || a.Type == SpinOff
+}
+
+// IsBuiltIn is true for the actions of the built in table
+func (a *CorporateAction) IsBuiltIn() bool {
+	return a.builtIn
+}
+
+// IsSplit is true for forward and reverse splits
+func (a *CorporateAction) IsSplit() bool {
+	return a.Type == ForwardSplit || a.Type == ReverseSplit
+}
+
+func (a *CorporateAction) appliesTo(isin, ticker string) bool {
+	if a.Isin != "" && isin != "" {
+		return a.Isin == isin
+	}
+	return a.Ticker != "" && a.Ticker == ticker
+}
+
+func (c *CorporateActionsStruct) GetActionsFor(record Record) []CorporateAction {
+	isin, ticker := record.Isin, record.Ticker
+
+	actions := []CorporateAction{}
+	for _, action := range c.actions {
+		if action.IsEvent() || !record.Time.Before(action.effectiveDate) ||
+			!action.appliesTo(isin, ticker) {
+			continue
+		}
+
+		actions = append(actions, action)
+		switch action.Type {
+		case TickerChange:
+			ticker = action.NewTicker
+		case IsinChange:
+			isin = action.NewIsin
+		}
+	}
+	return actions
+}
+
+func (c *CorporateActionsStruct) FindSplit(isin, ticker string, date time.Time,
+	window time.Duration) (CorporateAction, bool) {
+	for _, action := range c.actions {
+		if !action.IsSplit() || !action.appliesTo(isin, ticker) {
+			continue
+		}
+		if TimeIsBetween(action.effectiveDate, date.Add(-window), date.Add(window)) {
+			return action, true
+		}
+	}
+	return CorporateAction{}, false
+}
+
+func (c *CorporateActionsStruct) GetEvents(from, until time.Time) []CorporateAction {
+	events := []CorporateAction{}
+	for _, action := range c.actions {
+		if action.IsEvent() && action.effectiveDate.After(from) && !action.effectiveDate.After(until) {
+			events = append(events, action)
+		}
+	}
+	return events
+}
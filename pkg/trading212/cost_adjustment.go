@@ -0,0 +1,204 @@
+package trading212
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/ansel1/merry/v2"
+	"github.com/go-logr/logr"
+	"github.com/shopspring/decimal"
+)
+
+type CostAdjustmentSource string
+
+const (
+	ExportSource CostAdjustmentSource = "export"
+	ManualSource CostAdjustmentSource = "manual"
+)
+
+// CostAdjustmentFileEntry is a reduction of the cost of the shares held, e.g.
+// a return of capital, from the manual adjustments file
+type CostAdjustmentFileEntry struct {
+	Isin   string `json:"ISIN"`
+	Ticker string `json:"Ticker"`
+	Date   string `json:"Date"`
+	// Amount is the total reduction in EUR
+	Amount decimal.Decimal `json:"Amount"`
+	Notes  string          `json:"Notes"`
+}
+
+type CostAdjustmentsFile struct {
+	Adjustments []CostAdjustmentFileEntry `json:"adjustments"`
+}
+
+// CostAdjustment reduces the cost of the open lots of an instrument pro rata
+// to the shares held
+type CostAdjustment struct {
+	ID     string
+	Isin   string
+	Ticker string
+	Date   time.Time
+	// Amount is the total reduction in EUR
+	Amount decimal.Decimal
+	Source CostAdjustmentSource
+	Notes  string
+
+	// CostReduction is the part of the amount taken off the cost of the lots
+	CostReduction decimal.Decimal
+	// ExcessGain is the part of the amount above the cost of the lots, which
+	// is a gain
+	ExcessGain decimal.Decimal
+}
+
+// LoadCostAdjustments reads the manual adjustments file at the given path,
+// returning the adjustments in date order
+func LoadCostAdjustments(filePath string) ([]CostAdjustment, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, merry.Errorf("failed to open adjustments file: %w", err)
+	}
+	defer file.Close()
+
+	adjustmentsFile := CostAdjustmentsFile{}
+	err = json.NewDecoder(file).Decode(&adjustmentsFile)
+	if err != nil {
+		return nil, merry.Errorf("failed to parse adjustments file: %w", err)
+	}
+
+	adjustments := []CostAdjustment{}
+	for i, entry := range adjustmentsFile.Adjustments {
+		date, err := time.Parse(time.DateOnly, entry.Date)
+		if err != nil {
+			return nil, merry.Errorf("failed to parse adjustment date '%s': %w", entry.Date, err)
+		}
+		if entry.Isin == "" && entry.Ticker == "" {
+			return nil, merry.Errorf("adjustment on %s has no ISIN or ticker", entry.Date)
+		}
+		if !entry.Amount.IsPositive() {
+			return nil, merry.Errorf("adjustment on %s needs a positive amount", entry.Date)
+		}
+
+		adjustments = append(adjustments, CostAdjustment{
+			ID:     fmt.Sprintf("adjustment-%d", i+1),
+			Isin:   entry.Isin,
+			Ticker: entry.Ticker,
+			Date:   date,
+			Amount: entry.Amount,
+			Source: ManualSource,
+			Notes:  entry.Notes,
+		})
+	}
+
+	slices.SortStableFunc(adjustments, func(first, second CostAdjustment) int {
+		return first.Date.Compare(second.Date)
+	})
+	return adjustments, nil
+}
+
+// IsReturnOfCapital is true for the distributions that are a return of
+// capital rather than a dividend
+func (r *Record) IsReturnOfCapital() bool {
+	return r.Action == ReturnOfCapital
+}
+
+// NewCostAdjustment returns the adjustment for a return of capital row of the
+// export
+func NewCostAdjustment(record Record) CostAdjustment {
+	return CostAdjustment{
+		ID:     record.ID,
+		Isin:   record.Isin,
+		Ticker: record.Ticker,
+		Date:   record.Time,
+		Amount: record.Total,
+		Source: ExportSource,
+		Notes:  record.Notes,
+	}
+}
+
+// AdjustCost takes the adjustment off the cost of the lots held on its date,
+// pro rata to their shares. Where the share of a lot is more than its cost,
+// the cost goes to zero and the excess is recorded as a gain.
+func (q *PurchaseHistoryStruct) AdjustCost(log logr.Logger, adjustment CostAdjustment) error {
+	lots := []*Record{}
+	held := decimal.NewFromInt(0)
+	for _, lot := range q.recordQueue.GetQueue() {
+		if lot.Time.After(adjustment.Date) {
+			continue
+		}
+		lots = append(lots, lot)
+		held = held.Add(lot.NoOfShares)
+	}
+	if !held.IsPositive() {
+		log.V(0).Info("WARNING: cost adjustment for shares not held, it is ignored",
+			"ticker", adjustment.Ticker, "date", adjustment.Date.Format(time.DateOnly),
+			"amount", adjustment.Amount)
+		return nil
+	}
+
+	adjustment.CostReduction = decimal.NewFromInt(0)
+	adjustment.ExcessGain = decimal.NewFromInt(0)
+	excess := &Disposal{
+		ID:           adjustment.ID,
+		Date:         adjustment.Date,
+		Isin:         lots[0].Isin,
+		Ticker:       lots[0].Ticker,
+		Name:         lots[0].Name,
+		Type:         lots[0].GetType(),
+		Quantity:     decimal.NewFromInt(0),
+		ExchangeRate: decimal.NewFromInt(1),
+		Lots:         []DisposalLot{},
+	}
+
+	for _, lot := range lots {
+		amount := adjustment.Amount.Mul(lot.NoOfShares).Div(held)
+		cost := lot.GetCost()
+		reduction := decimal.Min(amount, cost)
+
+		if cost.IsPositive() {
+			lot.ScaleCost(decimal.NewFromInt(1).Sub(reduction.Div(cost)))
+		}
+		adjustment.CostReduction = adjustment.CostReduction.Add(reduction)
+
+		if amount.GreaterThan(reduction) {
+			adjustment.ExcessGain = adjustment.ExcessGain.Add(amount.Sub(reduction))
+			excess.AddLot(DisposalLot{
+				BuyID:        lot.ID,
+				BuyDate:      lot.Time,
+				Quantity:     decimal.NewFromInt(0),
+				Cost:         decimal.NewFromInt(0),
+				Proceeds:     amount.Sub(reduction),
+				BuyFees:      decimal.NewFromInt(0),
+				SellFees:     decimal.NewFromInt(0),
+				ExchangeRate: decimal.NewFromInt(1),
+				Method:       CorporateActionMatch,
+			})
+		}
+	}
+
+	if len(excess.Lots) > 0 {
+		err := q.recordDisposal(excess)
+		if err != nil {
+			return merry.Errorf("failed to record excess gain: %w", err)
+		}
+	}
+	q.costAdjustments = append(q.costAdjustments, &adjustment)
+
+	log.V(1).Info("cost adjustment",
+		"ticker", adjustment.Ticker,
+		"date", adjustment.Date.Format(time.DateOnly),
+		"amount", adjustment.Amount.String(),
+		"costReduction", adjustment.CostReduction.String(),
+		"excessGain", adjustment.ExcessGain.String())
+	return nil
+}
+
+func (q *PurchaseHistoryStruct) GetCostAdjustments() []CostAdjustment {
+	adjustments := []CostAdjustment{}
+	for _, adjustment := range q.costAdjustments {
+		adjustments = append(adjustments, *adjustment)
+	}
+	return adjustments
+}
@@ -4,7 +4,8 @@ package trading212
 
 import (
 	"encoding/csv"
-	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"regexp"
 	"strings"
@@ -15,59 +16,151 @@ import (
 	"github.com/ansel1/merry/v2"
 )
 
+// decimalRegex matches the signed decimals in the history files, scientific
+// notation and thousands separators are not accepted
+var decimalRegex = regexp.MustCompile(`^[+-]?\d+(\.\d+)?$`)
+
+// CellError is a value of a history file that could not be parsed
+type CellError struct {
+	Path string
+	// Line and Column are 1 based, Column is the position of the column in
+	// the header
+	Line   int
+	Column int
+	Header string
+	Value  string
+	Err    error
+}
+
+func (e CellError) Error() string {
+	return fmt.Sprintf("%s line %d column %d '%s': invalid value '%s': %v",
+		e.Path, e.Line, e.Column, e.Header, e.Value, e.Err)
+}
+
+func (e CellError) Unwrap() error {
+	return e.Err
+}
+
 type Scanner struct {
-	Reader *csv.Reader
-	Head   []string
-	Row    []string
+	Reader  *csv.Reader
+	Head    []string
+	Row     []string
+	Mapping ColumnMapping
+	// Path is the file being read, used in the errors
+	Path string
+	// Lenient zeroes the values that can not be parsed and adds them to
+	// CellErrors, instead of failing the row
+	Lenient    bool
+	CellErrors []CellError
+
+	err error
 }
 
-func NewScanner(o io.Reader) Scanner {
+// NewScanner reads the header of the history file and maps its columns to
+// the record fields
+func NewScanner(o io.Reader, filePath string) (Scanner, error) {
 	csv_o := csv.NewReader(o)
+	// the number of fields is checked by Scan, so notes can be skipped
+	csv_o.FieldsPerRecord = -1
 	header, err := csv_o.Read()
 	if err != nil {
-		return Scanner{}
+		return Scanner{}, merry.Errorf("failed to read header: %w", err)
+	}
+	mapping, err := NewColumnMapping(header)
+	if err != nil {
+		return Scanner{}, merry.Errorf("failed to map header: %w", err)
 	}
-	return Scanner{Reader: csv_o, Head: header}
+	return Scanner{Reader: csv_o, Head: header, Mapping: mapping, Path: filePath}, nil
 }
 
+// Scan reads the next row, skipping the rows that are a single "//" note
 func (o *Scanner) Scan() bool {
-	row, err := o.Reader.Read()
-	if err != nil {
-		return false
+	for {
+		row, err := o.Reader.Read()
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				o.err = err
+			}
+			return false
+		}
+		if len(row) == 1 && strings.HasPrefix(strings.TrimSpace(row[0]), "//") {
+			continue
+		}
+		if len(row) != len(o.Head) {
+			line, _ := o.Reader.FieldPos(0)
+			o.err = merry.Errorf("line %d has %d fields, the header has %d", line, len(row), len(o.Head))
+			return false
+		}
+		o.Row = row
+		return true
 	}
-	o.Row = row
-	return true
 }
 
-func (o *Scanner) toJson() string {
-	json := ""
-	for i, value := range o.Row {
-		value = strings.TrimSpace(value)
-		if i != 0 {
-			json += ",\n"
+// Err returns the error that stopped the scan, nil at the end of the file
+func (o *Scanner) Err() error {
+	if o.err != nil {
+		return merry.Errorf("failed to read '%s': %w", o.Path, o.err)
+	}
+	return nil
+}
+
+func (o *Scanner) newCellError(column, value string, err error) CellError {
+	cellError := CellError{Path: o.Path, Header: column, Value: value, Err: err}
+
+	index, ok := o.Mapping.GetColumnIndex(column)
+	if ok {
+		cellError.Column = index + 1
+		cellError.Header = o.Head[index]
+		cellError.Line, _ = o.Reader.FieldPos(index)
+	}
+	return cellError
+}
+
+// parseDecimal parses the value of the column, an empty value is zero. In
+// lenient mode a bad value is zeroed and kept in CellErrors.
+func (o *Scanner) parseDecimal(column, value string) (decimal.Decimal, error) {
+	if value == "" {
+		return decimal.Decimal{}, nil
+	}
+
+	err := merry.New("not a signed decimal")
+	if decimalRegex.MatchString(value) {
+		var out decimal.Decimal
+		out, err = decimal.NewFromString(value)
+		if err == nil {
+			return out, nil
 		}
-		json += "\"" + o.Head[i] + "\":\"" + value + "\""
 	}
-	json = "{\n" + json + "\n}"
-	return json
+
+	cellError := o.newCellError(column, value, err)
+	if o.Lenient {
+		o.CellErrors = append(o.CellErrors, cellError)
+		return decimal.Decimal{}, nil
+	}
+	return decimal.Decimal{}, cellError
 }
 
+// ToRecord parses the current row. A time that can not be parsed fails the
+// row even in lenient mode, as the record can not be placed without it. An
+// unknown action is left empty in lenient mode and the row is not processed.
 func (o *Scanner) ToRecord() (Record, error) {
 	record := Record{}
+	recordDto := o.Mapping.ToRecordDTO(o.Row)
 
-	jsonString := []byte(o.toJson())
-	recordDto := RecordDTO{}
-	err := json.Unmarshal(jsonString, &recordDto)
+	// cannot find a cleaner and simpler way to do this
+	action, err := ParseAction(recordDto.Action)
 	if err != nil {
-		return record, merry.Errorf("failed to unmarshall json to record: %w", err)
+		cellError := o.newCellError("action", recordDto.Action, err)
+		if !o.Lenient {
+			return record, merry.Errorf("failed to parse action: %w", cellError)
+		}
+		o.CellErrors = append(o.CellErrors, cellError)
 	}
-
-	// cannot find a cleaner and simpler way to do this
-	record.Action = recordDto.Action
+	record.Action = action
 	recordDto.Time = strings.Replace(recordDto.Time, "\xc2\xa0", " ", -1)
 	parsedTime, err := time.Parse("2006-01-02 15:04:05", recordDto.Time)
 	if err != nil {
-		return record, merry.Errorf("failed to parse time: %w", err)
+		return record, merry.Errorf("failed to parse time: %w", o.newCellError("time", recordDto.Time, err))
 	}
 	record.Time = parsedTime
 	record.Isin = recordDto.Isin
@@ -81,54 +174,41 @@ func (o *Scanner) ToRecord() (Record, error) {
 	record.Notes = recordDto.Notes
 	record.ID = recordDto.ID
 	record.CurrencyCurrencyConversionFee = recordDto.CurrencyCurrencyConversionFee
+	record.Extra = recordDto.Extra
+	record.Source = o.Path
+	record.Line, _ = o.Reader.FieldPos(0)
 
-	parseFloatIgnoreEmptyString := func(value string) (decimal.Decimal, error) {
-		var out decimal.Decimal
-		if regexp.MustCompile(`^\d+(\.\d+)?$`).MatchString(value) {
-			out, err = decimal.NewFromString(value)
-			if err != nil {
-				return out, merry.Errorf("failed to parse float: %w", err)
-			}
-		}
-		return out, nil
-	}
-
-	record.NoOfShares, err = parseFloatIgnoreEmptyString(recordDto.NoOfShares)
-	if err != nil {
-		return record, merry.Errorf("failed to parse float for record DTO 'NoOfShares': %w", err)
-	}
-	record.PriceShare, err = parseFloatIgnoreEmptyString(recordDto.PriceShare)
+	record.NoOfShares, err = o.parseDecimal("no. of shares", recordDto.NoOfShares)
 	if err != nil {
-		return record, merry.Errorf("failed to parse float for record DTO 'PriceShare': %w", err)
+		return record, merry.Errorf("failed to parse 'NoOfShares': %w", err)
 	}
-	record.ExchangeRate, err = parseFloatIgnoreEmptyString(recordDto.ExchangeRate)
+	record.PriceShare, err = o.parseDecimal("price / share", recordDto.PriceShare)
 	if err != nil {
-		return record, merry.Errorf("failed to parse float for record DTO 'ExchangeRate': %w", err)
+		return record, merry.Errorf("failed to parse 'PriceShare': %w", err)
 	}
-	record.Result, err = parseFloatIgnoreEmptyString(recordDto.Result)
+	record.ExchangeRate, err = o.parseDecimal("exchange rate", recordDto.ExchangeRate)
 	if err != nil {
-		return record, merry.Errorf("failed to parse float for record DTO 'Result': %w", err)
+		return record, merry.Errorf("failed to parse 'ExchangeRate': %w", err)
 	}
-	record.Total, err = parseFloatIgnoreEmptyString(recordDto.Total)
+	record.Result, err = o.parseDecimal("result", recordDto.Result)
 	if err != nil {
-		return record, merry.Errorf("failed to parse float for record DTO 'Total': %w", err)
+		return record, merry.Errorf("failed to parse 'Result': %w", err)
 	}
-	record.WithholdingTax, err = parseFloatIgnoreEmptyString(recordDto.WithholdingTax)
+	record.Total, err = o.parseDecimal("total", recordDto.Total)
 	if err != nil {
-		return record, merry.Errorf("failed to parse float for record DTO 'WithholdingTax': %w", err)
+		return record, merry.Errorf("failed to parse 'Total': %w", err)
 	}
-	record.StampDutyReserveTax, err = parseFloatIgnoreEmptyString(recordDto.StampDutyReserveTax)
+	record.WithholdingTax, err = o.parseDecimal("withholding tax", recordDto.WithholdingTax)
 	if err != nil {
-		return record, merry.Errorf("failed to parse float for record DTO 'StampDutyReserveTax': %w", err)
+		return record, merry.Errorf("failed to parse 'WithholdingTax': %w", err)
 	}
-	record.CurrencyConversionFee, err = parseFloatIgnoreEmptyString(recordDto.CurrencyConversionFee)
+	record.StampDutyReserveTax, err = o.parseDecimal("stamp duty reserve tax", recordDto.StampDutyReserveTax)
 	if err != nil {
-		return record, merry.Errorf("failed to parse float for record DTO 'CurrencyConversionFee': %w", err)
+		return record, merry.Errorf("failed to parse 'StampDutyReserveTax': %w", err)
 	}
-	err = record.AdjustForSplit()
+	record.CurrencyConversionFee, err = o.parseDecimal("currency conversion fee", recordDto.CurrencyConversionFee)
 	if err != nil {
-		return record, merry.Errorf("failed to adjust for split: %w", err)
+		return record, merry.Errorf("failed to parse 'CurrencyConversionFee': %w", err)
 	}
-
 	return record, nil
 }
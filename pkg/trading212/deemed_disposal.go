@@ -0,0 +1,175 @@
+package trading212
+
+import (
+	"time"
+
+	"github.com/ansel1/merry/v2"
+	"github.com/go-logr/logr"
+	"github.com/shopspring/decimal"
+)
+
+// DeemedDisposalYears is the period after which a fund holding is treated as
+// disposed of and reacquired at market value
+const DeemedDisposalYears = 8
+
+type ExitTaxRates interface {
+	GetExitTaxRate(year int) (decimal.Decimal, error)
+}
+
+// DeemedDisposal is a fund lot treated as disposed of on an 8th anniversary of
+// its acquisition. All amounts are in EUR.
+type DeemedDisposal struct {
+	Isin   string
+	Ticker string
+	Name   string
+
+	BuyID      string
+	AcquiredAt time.Time
+	Date       time.Time
+
+	Quantity decimal.Decimal
+	Cost     decimal.Decimal
+	// Priced is false when there was no recent price for the date, in which
+	// case the value, gain and tax are not known and the anniversary is left
+	// pending
+	Priced      bool
+	Price       decimal.Decimal
+	MarketValue decimal.Decimal
+	Gain        decimal.Decimal
+	Rate        decimal.Decimal
+	// Tax is the exit tax due, after credit for the tax already paid on
+	// earlier deemed disposals of the lot
+	Tax decimal.Decimal
+}
+
+func (d *DeemedDisposal) GetYear() int {
+	return d.Date.Year()
+}
+
+// getNextDeemedDisposalDate returns the next anniversary of the lot that has
+// not been processed yet
+func getNextDeemedDisposalDate(lot *Record) time.Time {
+	return lot.Time.AddDate(DeemedDisposalYears*(lot.DeemedDisposalCount+1), 0, 0)
+}
+
+// ProcessDeemedDisposals creates a deemed disposal for every anniversary of
+// the open fund lots up to the given time. The tax paid is kept on the lot
+// so it can be credited against the eventual real disposal. An anniversary
+// without a recent price is reported once and left pending, with the later
+// anniversaries of the lot, until a price is added.
+func (q *PurchaseHistoryStruct) ProcessDeemedDisposals(log logr.Logger, until time.Time,
+	prices PriceBook, rates ExitTaxRates) error {
+	for _, lot := range q.recordQueue.GetQueue() {
+		if lot.GetType() != ETF {
+			continue
+		}
+
+		for date := getNextDeemedDisposalDate(lot); !date.After(until); date = getNextDeemedDisposalDate(lot) {
+			deemedDisposal := DeemedDisposal{
+				Isin:       lot.Isin,
+				Ticker:     lot.Ticker,
+				Name:       lot.Name,
+				BuyID:      lot.ID,
+				AcquiredAt: lot.Time,
+				Date:       date,
+				Quantity:   lot.NoOfShares,
+				Cost:       lot.GetCost(),
+			}
+
+			price, priceDate, ok := getRecentPrice(prices, lot.Isin, lot.Ticker, date)
+			if !ok {
+				if !lot.UnpricedDeemedDisposal.Equal(date) {
+					log.V(0).Info("WARNING: no recent price for deemed disposal, it is not taxed until the "+
+						"price is added to the prices file",
+						"ticker", lot.Ticker,
+						"isin", lot.Isin,
+						"date", date.Format(time.DateOnly),
+						"latest price", formatPriceDate(priceDate),
+						"quantity", lot.NoOfShares.String())
+					lot.UnpricedDeemedDisposal = date
+					q.deemedDisposals = append(q.deemedDisposals, &deemedDisposal)
+				}
+				break
+			}
+
+			rate, err := rates.GetExitTaxRate(date.Year())
+			if err != nil {
+				return merry.Errorf("failed to get exit tax rate: %w", err)
+			}
+
+			deemedDisposal.Priced = true
+			deemedDisposal.Price = price
+			deemedDisposal.MarketValue = price.Mul(lot.NoOfShares)
+			deemedDisposal.Gain = deemedDisposal.MarketValue.Sub(deemedDisposal.Cost)
+			deemedDisposal.Rate = rate
+
+			// the gain is always from the original cost, so only the tax
+			// above what was paid on earlier anniversaries is due
+			tax := decimal.Max(deemedDisposal.Gain, decimal.NewFromInt(0)).Mul(rate)
+			alreadyPaid := lot.DeemedDisposalTaxPerShare.Mul(lot.NoOfShares)
+			deemedDisposal.Tax = decimal.Max(tax.Sub(alreadyPaid), decimal.NewFromInt(0)).Round(2)
+			if lot.NoOfShares.GreaterThan(decimal.NewFromInt(0)) {
+				lot.DeemedDisposalTaxPerShare = lot.DeemedDisposalTaxPerShare.Add(
+					deemedDisposal.Tax.Div(lot.NoOfShares))
+			}
+
+			log.V(1).Info("deemed disposal",
+				"ticker", lot.Ticker,
+				"acquired", lot.Time.Format(time.DateOnly),
+				"date", date.Format(time.DateOnly),
+				"quantity", deemedDisposal.Quantity.String(),
+				"gain", deemedDisposal.Gain.String(),
+				"tax", deemedDisposal.Tax.String())
+
+			lot.DeemedDisposalCount++
+			q.deemedDisposals = append(q.deemedDisposals, &deemedDisposal)
+		}
+	}
+	return nil
+}
+
+func (q *PurchaseHistoryStruct) GetDeemedDisposalsForYear(year int) []DeemedDisposal {
+	deemedDisposals := []DeemedDisposal{}
+	for _, deemedDisposal := range q.deemedDisposals {
+		if deemedDisposal.GetYear() == year {
+			deemedDisposals = append(deemedDisposals, *deemedDisposal)
+		}
+	}
+	return deemedDisposals
+}
+
+// GetUpcomingDeemedDisposals lists the next anniversary of every open fund
+// lot after the given time, valued at the latest known price
+func (q *PurchaseHistoryStruct) GetUpcomingDeemedDisposals(after time.Time, prices PriceBook) []DeemedDisposal {
+	upcoming := []DeemedDisposal{}
+	for _, lot := range q.recordQueue.GetQueue() {
+		if lot.GetType() != ETF {
+			continue
+		}
+
+		date := getNextDeemedDisposalDate(lot)
+		for !date.After(after) {
+			date = date.AddDate(DeemedDisposalYears, 0, 0)
+		}
+
+		deemedDisposal := DeemedDisposal{
+			Isin:       lot.Isin,
+			Ticker:     lot.Ticker,
+			Name:       lot.Name,
+			BuyID:      lot.ID,
+			AcquiredAt: lot.Time,
+			Date:       date,
+			Quantity:   lot.NoOfShares,
+			Cost:       lot.GetCost(),
+		}
+		price, _, ok := prices.GetPrice(lot.Isin, lot.Ticker, after)
+		if ok {
+			deemedDisposal.Priced = true
+			deemedDisposal.Price = price
+			deemedDisposal.MarketValue = price.Mul(lot.NoOfShares)
+			deemedDisposal.Gain = deemedDisposal.MarketValue.Sub(deemedDisposal.Cost)
+		}
+		upcoming = append(upcoming, deemedDisposal)
+	}
+	return upcoming
+}
@@ -0,0 +1,117 @@
+package trading212
+
+import (
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+type MatchMethod string
+
+const (
+	FIFO MatchMethod = "FIFO"
+	LIFO MatchMethod = "LIFO"
+	// CorporateActionMatch is a lot disposed of by a corporate action
+	CorporateActionMatch MatchMethod = "CorporateAction"
+)
+
+// DisposalLot is the part of an acquisition lot that was matched against
+// a disposal. All amounts are in EUR.
+type DisposalLot struct {
+	BuyID   string
+	BuyDate time.Time
+
+	Quantity decimal.Decimal
+	// Cost includes the proportional buy fees
+	Cost decimal.Decimal
+	// Proceeds is the share of the sale proceeds for this lot, net of the
+	// proportional sell fees
+	Proceeds decimal.Decimal
+	BuyFees  decimal.Decimal
+	SellFees decimal.Decimal
+	// ExchangeRate is the rate used to convert the buy price to EUR
+	ExchangeRate decimal.Decimal
+	Method       MatchMethod
+	// RingFencedLossUsed is the ring-fenced loss carried by the lot that was
+	// offset against the gain on it
+	RingFencedLossUsed decimal.Decimal
+	// DeemedDisposalCredit is the exit tax already paid on deemed disposals
+	// of the shares
+	DeemedDisposalCredit decimal.Decimal
+	// ManualReason is set when the acquisition is a manual transaction
+	ManualReason string `json:",omitempty"`
+}
+
+func (l *DisposalLot) GetProfit() decimal.Decimal {
+	return l.Proceeds.Sub(l.Cost)
+}
+
+// Disposal is the audit record for a single sell, listing every acquisition
+// lot it was matched against
+type Disposal struct {
+	ID     string
+	Date   time.Time
+	Isin   string
+	Ticker string
+	Name   string
+	Type   RecordType
+
+	Quantity decimal.Decimal
+	Proceeds decimal.Decimal
+	Cost     decimal.Decimal
+	Profit   decimal.Decimal
+	// ExchangeRate is the rate used to convert the sell price to EUR
+	ExchangeRate decimal.Decimal
+
+	// RestrictedLoss is the part of the loss that was ring-fenced because
+	// the shares were reacquired within 4 weeks
+	RestrictedLoss decimal.Decimal
+	// RingFencedLossUsed is the ring-fenced loss released against the gain
+	// of this disposal
+	RingFencedLossUsed decimal.Decimal
+	// RingFencedLossForfeited is the ring-fenced loss tied to the shares
+	// disposed of that could not be used as there was no gain to offset
+	RingFencedLossForfeited decimal.Decimal
+	// DeemedDisposalCredit is the exit tax already paid on deemed disposals
+	// of the shares sold
+	DeemedDisposalCredit decimal.Decimal
+
+	// ManualReason is set when the disposal is a manual transaction
+	ManualReason string `json:",omitempty"`
+
+	Lots []DisposalLot
+}
+
+func NewDisposal(sellRecord Record) *Disposal {
+	return &Disposal{
+		ID:           sellRecord.ID,
+		Date:         sellRecord.Time,
+		Isin:         sellRecord.Isin,
+		Ticker:       sellRecord.Ticker,
+		Name:         sellRecord.Name,
+		Type:         sellRecord.GetType(),
+		Quantity:     sellRecord.NoOfShares,
+		ExchangeRate: sellRecord.ExchangeRate,
+		ManualReason: sellRecord.ManualReason,
+		Lots:         []DisposalLot{},
+	}
+}
+
+func (d *Disposal) AddLot(lot DisposalLot) {
+	d.Lots = append(d.Lots, lot)
+	d.Proceeds = d.Proceeds.Add(lot.Proceeds)
+	d.Cost = d.Cost.Add(lot.Cost)
+	d.Profit = d.Proceeds.Sub(d.Cost)
+	d.RingFencedLossUsed = d.RingFencedLossUsed.Add(lot.RingFencedLossUsed)
+	d.DeemedDisposalCredit = d.DeemedDisposalCredit.Add(lot.DeemedDisposalCredit)
+}
+
+// GetChargeableProfit returns the profit after ring-fenced losses are taken
+// out of it, or released against it
+func (d *Disposal) GetChargeableProfit() decimal.Decimal {
+	return d.Profit.Sub(d.RestrictedLoss).Add(d.RingFencedLossUsed)
+}
+
+func (d *Disposal) GetYear() int {
+	return d.Date.Year()
+}
@@ -0,0 +1,117 @@
+package trading212
+
+import (
+	"time"
+
+	"github.com/ansel1/merry/v2"
+	"github.com/go-logr/logr"
+	"github.com/shopspring/decimal"
+)
+
+// DividendPayment is a dividend row of the export, the amounts are in EUR
+type DividendPayment struct {
+	ID     string
+	Isin   string
+	Ticker string
+	Name   string
+	// Country is where the dividend comes from, taken from the ISIN prefix
+	Country string
+	Date    time.Time
+	Action  Action
+	Type    RecordType
+
+	// Gross is the dividend before the withholding tax, Net is what was paid
+	// into the account
+	Gross          decimal.Decimal
+	WithholdingTax decimal.Decimal
+	Net            decimal.Decimal
+}
+
+func (d *DividendPayment) GetYear() int {
+	return d.Date.Year()
+}
+
+// GetCountry returns the country prefix of the ISIN, empty if there is no ISIN
+func GetCountry(isin string) string {
+	if len(isin) < 2 {
+		return ""
+	}
+	return isin[:2]
+}
+
+// NewDividendPayment returns the payment of a dividend row. The withholding
+// tax is in the currency of the instrument, unless it is in EUR, and is
+// converted with the exchange rate of the row. It has the sign of the Total,
+// so a negative adjustment reverses the withholding tax along with the gross.
+func NewDividendPayment(record Record) (DividendPayment, error) {
+	withholdingTax := record.WithholdingTax.Abs()
+	if record.Total.IsNegative() {
+		withholdingTax = withholdingTax.Neg()
+	}
+	if record.CurrencyWithholdingTax != "" && record.CurrencyWithholdingTax != "EUR" &&
+		!withholdingTax.IsZero() {
+		if record.CurrencyWithholdingTax != record.CurrencyPriceShare {
+			return DividendPayment{}, merry.Errorf("withholding tax of dividend '%s' is in %s but the price is in %s",
+				record.ID, record.CurrencyWithholdingTax, record.CurrencyPriceShare)
+		}
+		if record.ExchangeRate.IsZero() {
+			return DividendPayment{}, merry.Errorf("dividend '%s' has no exchange rate for its withholding tax",
+				record.ID)
+		}
+		withholdingTax = withholdingTax.Div(record.ExchangeRate)
+	}
+
+	return DividendPayment{
+		ID:             record.ID,
+		Isin:           record.Isin,
+		Ticker:         record.Ticker,
+		Name:           record.Name,
+		Country:        GetCountry(record.Isin),
+		Date:           record.Time,
+		Action:         record.Action,
+		Type:           record.GetType(),
+		Gross:          record.Total.Add(withholdingTax),
+		WithholdingTax: withholdingTax,
+		Net:            record.Total,
+	}, nil
+}
+
+func (q *PurchaseHistoryStruct) processDividend(log logr.Logger, record *Record) error {
+	dividend, err := NewDividendPayment(*record)
+	if err != nil {
+		return merry.Errorf("failed to read dividend: %w", err)
+	}
+
+	// distributions of funds are taxed under the fund regime, they are kept
+	// apart from the dividends of shares
+	if dividend.Type == ETF {
+		log.V(1).Info("fund distribution",
+			"ticker", dividend.Ticker,
+			"date", dividend.Date.Format(time.DateOnly),
+			"gross", dividend.Gross,
+			"withholding tax", dividend.WithholdingTax,
+			"net", dividend.Net,
+		)
+		q.fundDistributions = append(q.fundDistributions, dividend)
+		return nil
+	}
+
+	log.V(1).Info("dividend",
+		"ticker", dividend.Ticker,
+		"date", dividend.Date.Format(time.DateOnly),
+		"country", dividend.Country,
+		"gross", dividend.Gross,
+		"withholding tax", dividend.WithholdingTax,
+		"net", dividend.Net,
+	)
+	q.dividends = append(q.dividends, dividend)
+	return nil
+}
+
+func (q *PurchaseHistoryStruct) GetDividends() []DividendPayment {
+	return q.dividends
+}
+
+func (q *PurchaseHistoryStruct) GetFundDistributions() []DividendPayment {
+	return q.fundDistributions
+}
@@ -0,0 +1,148 @@
+package trading212
+
+import (
+	"cmp"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"slices"
+
+	"github.com/ansel1/merry/v2"
+)
+
+// getSortRank orders the records at the same instant, buys are processed
+// before anything else and sells after
+func (r *Record) getSortRank() int {
+	if r.Action.IsBuy() {
+		return 0
+	}
+	if r.Action.IsSell() {
+		return 2
+	}
+	return 1
+}
+
+// SortRecords orders the records from every source by time. Records at the
+// same instant have the buys first and the sells last, then are ordered by ID.
+func SortRecords(records []Record) {
+	slices.SortStableFunc(records, func(first, second Record) int {
+		return cmp.Or(first.Time.Compare(second.Time),
+			cmp.Compare(first.getSortRank(), second.getSortRank()),
+			cmp.Compare(first.ID, second.ID))
+	})
+}
+
+// DuplicateRecord is a record that was dropped as it was already read, from
+// an overlapping export for example
+type DuplicateRecord struct {
+	Record Record
+	// Source is the file the duplicate was read from and FirstSource the
+	// file of the record that was kept
+	Source      string
+	FirstSource string
+}
+
+type RecordDeduplicator interface {
+	// Add returns false if the record was already added. Records are keyed
+	// on their ID, and it is an error for two records with the same ID to
+	// differ. Records without an ID are keyed on a hash of their content and
+	// are only duplicates of records from another source, as the same row can
+	// be in a file twice, e.g. two fills at the same price in the same second.
+	Add(record Record, source string) (bool, error)
+	GetDuplicates() []DuplicateRecord
+}
+
+type seenRecord struct {
+	hash   string
+	source string
+	// counts is the number of records without an ID read from each source
+	// with the hash, kept is the number added
+	counts map[string]int
+	kept   int
+}
+
+type RecordDeduplicatorStruct struct {
+	seen       map[string]*seenRecord
+	duplicates []DuplicateRecord
+}
+
+func NewRecordDeduplicator() RecordDeduplicator {
+	return &RecordDeduplicatorStruct{seen: make(map[string]*seenRecord)}
+}
+
+// GetContentHash returns a hash of every field of the record as read, with
+// the extra columns when withExtra is set
+func (r *Record) GetContentHash(withExtra bool) (string, error) {
+	var content any = r
+	if withExtra {
+		content = struct {
+			Record *Record
+			Extra  map[string]string
+		}{r, r.Extra}
+	}
+	data, err := json.Marshal(content)
+	if err != nil {
+		return "", merry.Errorf("failed to marshal record: %w", err)
+	}
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:]), nil
+}
+
+func (d *RecordDeduplicatorStruct) Add(record Record, source string) (bool, error) {
+	if record.ID == "" {
+		return d.addWithoutID(record, source)
+	}
+
+	hash, err := record.GetContentHash(false)
+	if err != nil {
+		return false, merry.Errorf("failed to hash record '%s': %w", record.ID, err)
+	}
+
+	seen, ok := d.seen[record.ID]
+	if !ok {
+		d.seen[record.ID] = &seenRecord{hash: hash, source: source}
+		return true, nil
+	}
+
+	if seen.hash != hash {
+		return false, merry.Errorf("records with the ID '%s' in '%s' and '%s' differ",
+			record.ID, seen.source, source)
+	}
+	d.addDuplicate(record, source, seen.source)
+	return false, nil
+}
+
+// addWithoutID keeps as many copies of the record as the source with the
+// most of them has, the copies from the other sources are duplicates
+func (d *RecordDeduplicatorStruct) addWithoutID(record Record, source string) (bool, error) {
+	hash, err := record.GetContentHash(true)
+	if err != nil {
+		return false, merry.Errorf("failed to hash record at line %d: %w", record.Line, err)
+	}
+
+	seen, ok := d.seen[hash]
+	if !ok {
+		seen = &seenRecord{hash: hash, source: source, counts: make(map[string]int)}
+		d.seen[hash] = seen
+	}
+	seen.counts[source]++
+	if seen.counts[source] > seen.kept {
+		seen.kept = seen.counts[source]
+		return true, nil
+	}
+
+	d.addDuplicate(record, source, seen.source)
+	return false, nil
+}
+
+func (d *RecordDeduplicatorStruct) addDuplicate(record Record, source, firstSource string) {
+	d.duplicates = append(d.duplicates, DuplicateRecord{
+		Record:      record,
+		Source:      source,
+		FirstSource: firstSource,
+	})
+}
+
+func (d *RecordDeduplicatorStruct) GetDuplicates() []DuplicateRecord {
+	return d.duplicates
+}
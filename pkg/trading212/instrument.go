@@ -0,0 +1,134 @@
+package trading212
+
+import (
+	"cmp"
+	"slices"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+// InstrumentAlias is an ISIN and ticker pair an instrument was seen with
+type InstrumentAlias struct {
+	Isin      string
+	Ticker    string
+	FirstSeen time.Time
+}
+
+// Instrument is an entry of the book with every identifier it was known by
+type Instrument struct {
+	// Key is the ISIN the instrument was first seen with, or its ticker for
+	// rows without an ISIN
+	Key     string
+	Aliases []InstrumentAlias
+}
+
+// TickerCollision is a new ISIN seen with the ticker of an instrument still
+// held under another ISIN. Instruments only seen by their ticker take the
+// ISIN instead. They are kept apart, as tickers are reused across
+// exchanges, unless an isin-change corporate action joins them.
+type TickerCollision struct {
+	ID       string
+	Date     time.Time
+	Ticker   string
+	Isin     string
+	HeldIsin string
+}
+
+// getInstrumentKey returns the key of the book entry for the record.
+// Instruments are identified by ISIN so that lots follow them across ticker
+// changes. ISIN changes are only followed through the corporate actions.
+func (b *BookKeeperStruct) getInstrumentKey(log logr.Logger, record Record) string {
+	if record.Isin == "" && record.Ticker == "" {
+		// not an instrument, e.g. a deposit
+		return ""
+	}
+
+	var key string
+	if record.Isin == "" {
+		var ok bool
+		key, ok = b.tickers[record.Ticker]
+		if !ok {
+			key = record.Ticker
+			log.V(0).Info("WARNING: no ISIN, the instrument is identified by its ticker and "+
+				"will not follow ticker changes",
+				"ticker", record.Ticker, "id", record.ID)
+		}
+	} else {
+		var ok bool
+		key, ok = b.isins[record.Isin]
+		if !ok {
+			key = record.Isin
+
+			tickerKey, ok := b.tickers[record.Ticker]
+			heldIsin := b.getIsin(tickerKey)
+			switch {
+			case ok && heldIsin == "":
+				// the rows without an ISIN, e.g. opening lots, are of the
+				// same instrument
+				key = tickerKey
+				log.V(1).Info("ISIN added to the instrument identified by its ticker",
+					"ticker", record.Ticker, "isin", record.Isin, "id", record.ID)
+			case ok && !b.book[tickerKey].GetRecordQueue().IsEmpty():
+				collision := TickerCollision{
+					ID:       record.ID,
+					Date:     record.Time,
+					Ticker:   record.Ticker,
+					Isin:     record.Isin,
+					HeldIsin: heldIsin,
+				}
+				b.tickerCollisions = append(b.tickerCollisions, collision)
+				log.V(0).Info("WARNING: new ISIN seen with the ticker of shares held under another ISIN, "+
+					"they are kept apart, add an isin-change corporate action if it is the same instrument",
+					"ticker", record.Ticker, "isin", record.Isin, "held isin", heldIsin, "id", record.ID)
+			}
+			b.isins[record.Isin] = key
+		}
+	}
+	b.tickers[record.Ticker] = key
+
+	b.addAlias(key, record)
+	return key
+}
+
+// getIsin returns the first ISIN the instrument was seen with, empty if it
+// was only seen by its ticker
+func (b *BookKeeperStruct) getIsin(key string) string {
+	for _, alias := range b.aliases[key] {
+		if alias.Isin != "" {
+			return alias.Isin
+		}
+	}
+	return ""
+}
+
+func (b *BookKeeperStruct) addAlias(key string, record Record) {
+	aliases := b.aliases[key]
+	if slices.ContainsFunc(aliases, func(alias InstrumentAlias) bool {
+		return alias.Isin == record.Isin && alias.Ticker == record.Ticker
+	}) {
+		return
+	}
+
+	b.aliases[key] = append(aliases, InstrumentAlias{
+		Isin:      record.Isin,
+		Ticker:    record.Ticker,
+		FirstSeen: record.Time,
+	})
+}
+
+func (b *BookKeeperStruct) GetInstruments() []Instrument {
+	instruments := []Instrument{}
+	for key, aliases := range b.aliases {
+		instruments = append(instruments, Instrument{Key: key, Aliases: aliases})
+	}
+	slices.SortFunc(instruments, func(first, second Instrument) int {
+		return cmp.Or(first.Aliases[0].FirstSeen.Compare(second.Aliases[0].FirstSeen),
+			cmp.Compare(first.Key, second.Key))
+	})
+	return instruments
+}
+
+func (b *BookKeeperStruct) GetTickerCollisions() []TickerCollision {
+	return b.tickerCollisions
+}
@@ -0,0 +1,87 @@
+package trading212
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+
+	"github.com/ansel1/merry/v2"
+	"github.com/shopspring/decimal"
+)
+
+// ManualTransaction is a buy or sell that is not in any export, e.g. shares
+// inherited or given as a gift. It has the same fields as a record, with the
+// time in RFC 3339 format.
+type ManualTransaction struct {
+	Record
+	// Reason explains why the transaction is not in the export
+	Reason string `json:"reason"`
+}
+
+type ManualTransactionsFile struct {
+	Transactions []ManualTransaction `json:"transactions"`
+}
+
+// LoadManualTransactions reads the manual transactions file at the given
+// path, returning them in time order
+func LoadManualTransactions(filePath string) ([]ManualTransaction, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, merry.Errorf("failed to open manual transactions file: %w", err)
+	}
+	defer file.Close()
+
+	transactionsFile := ManualTransactionsFile{}
+	err = json.NewDecoder(file).Decode(&transactionsFile)
+	if err != nil {
+		return nil, merry.Errorf("failed to parse manual transactions file: %w", err)
+	}
+
+	transactions := transactionsFile.Transactions
+	for i := range transactions {
+		transaction := &transactions[i]
+		if transaction.ID == "" {
+			transaction.ID = fmt.Sprintf("manual-%d", i+1)
+		}
+
+		if transaction.Reason == "" {
+			return nil, merry.Errorf("manual transaction '%s' has no reason", transaction.ID)
+		}
+		action, err := parseManualAction(string(transaction.Action))
+		if err != nil {
+			return nil, merry.Errorf("manual transaction '%s' is not a buy or sell: %w", transaction.ID, err)
+		}
+		transaction.Action = action
+		if transaction.Isin == "" && transaction.Ticker == "" {
+			return nil, merry.Errorf("manual transaction '%s' has no ISIN or ticker", transaction.ID)
+		}
+		if !transaction.NoOfShares.IsPositive() {
+			return nil, merry.Errorf("manual transaction '%s' needs a positive number of shares",
+				transaction.ID)
+		}
+
+		if transaction.ExchangeRate.IsZero() {
+			transaction.ExchangeRate = decimal.NewFromInt(1)
+		}
+		transaction.ManualReason = transaction.Reason
+	}
+
+	slices.SortStableFunc(transactions, func(first, second ManualTransaction) int {
+		return first.Time.Compare(second.Time)
+	})
+	return transactions, nil
+}
+
+// parseManualAction accepts the buy and sell actions of the exports,
+// including the legacy "buy" and "sell"
+func parseManualAction(value string) (Action, error) {
+	action, err := ParseAction(value)
+	if err != nil {
+		return "", err
+	}
+	if !action.IsBuy() && !action.IsSell() {
+		return "", merry.Errorf("unexpected action '%s'", value)
+	}
+	return action, nil
+}
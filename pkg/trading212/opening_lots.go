@@ -0,0 +1,81 @@
+package trading212
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/ansel1/merry/v2"
+	"github.com/shopspring/decimal"
+)
+
+// OpeningLotFileEntry is a holding transferred in from another broker
+type OpeningLotFileEntry struct {
+	Isin            string          `json:"ISIN"`
+	Ticker          string          `json:"Ticker"`
+	Name            string          `json:"Name"`
+	AcquisitionDate string          `json:"AcquisitionDate"`
+	Quantity        decimal.Decimal `json:"Quantity"`
+	// Cost is the total cost in EUR, including fees
+	Cost decimal.Decimal `json:"Cost"`
+	// Source is a note on where the holding came from
+	Source string `json:"Source"`
+}
+
+type OpeningLotsFile struct {
+	Lots []OpeningLotFileEntry `json:"lots"`
+}
+
+// LoadOpeningLots reads the opening lots file at the given path, returning a
+// buy record for every lot in date order
+func LoadOpeningLots(filePath string) ([]Record, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, merry.Errorf("failed to open opening lots file: %w", err)
+	}
+	defer file.Close()
+
+	openingLotsFile := OpeningLotsFile{}
+	err = json.NewDecoder(file).Decode(&openingLotsFile)
+	if err != nil {
+		return nil, merry.Errorf("failed to parse opening lots file: %w", err)
+	}
+
+	records := []Record{}
+	for i, lot := range openingLotsFile.Lots {
+		acquisitionDate, err := time.Parse(time.DateOnly, lot.AcquisitionDate)
+		if err != nil {
+			return nil, merry.Errorf("failed to parse acquisition date '%s': %w", lot.AcquisitionDate, err)
+		}
+		if lot.Isin == "" && lot.Ticker == "" {
+			return nil, merry.Errorf("opening lot %d has no ISIN or ticker", i+1)
+		}
+		if !lot.Quantity.IsPositive() || lot.Cost.IsNegative() {
+			return nil, merry.Errorf("opening lot %d needs a positive quantity and a cost", i+1)
+		}
+
+		records = append(records, Record{
+			Action:                        OpeningBuy,
+			Time:                          acquisitionDate,
+			Isin:                          lot.Isin,
+			Ticker:                        lot.Ticker,
+			Name:                          lot.Name,
+			NoOfShares:                    lot.Quantity,
+			PriceShare:                    lot.Cost.Div(lot.Quantity),
+			CurrencyPriceShare:            "EUR",
+			ExchangeRate:                  decimal.NewFromInt(1),
+			Total:                         lot.Cost,
+			CurrencyTotal:                 "EUR",
+			Notes:                         lot.Source,
+			ID:                            fmt.Sprintf("opening-lot-%d", i+1),
+			CurrencyCurrencyConversionFee: "EUR",
+		})
+	}
+
+	slices.SortStableFunc(records, func(first, second Record) int {
+		return first.Time.Compare(second.Time)
+	})
+	return records, nil
+}
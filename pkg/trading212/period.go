@@ -0,0 +1,37 @@
+package trading212
+
+import "time"
+
+// Period is the CGT payment period within a tax year. Gains made from
+// 1 January to 30 November are paid by 15 December, gains made in December
+// are paid by 31 January of the next year.
+type Period string
+
+const (
+	InitialPeriod Period = "Initial"
+	LaterPeriod   Period = "Later"
+)
+
+var Periods = []Period{InitialPeriod, LaterPeriod}
+
+type TaxPeriod struct {
+	Year   int
+	Period Period
+}
+
+func GetTaxPeriod(t time.Time) TaxPeriod {
+	period := InitialPeriod
+	if t.Month() == time.December {
+		period = LaterPeriod
+	}
+	return TaxPeriod{Year: t.Year(), Period: period}
+}
+
+// PeriodSummary holds every summary for a single payment period
+type PeriodSummary struct {
+	Profits                  StockSummary
+	SaleAggregates           StockSummary
+	LossAggregates           StockSummary
+	ProfitAggregates         StockSummary
+	RestrictedLossAggregates StockSummary
+}
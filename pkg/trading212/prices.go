@@ -0,0 +1,119 @@
+package trading212
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/ansel1/merry/v2"
+	"github.com/shopspring/decimal"
+)
+
+// PriceFileEntry is a single closing price in EUR from the local price file
+type PriceFileEntry struct {
+	Isin   string          `json:"ISIN"`
+	Ticker string          `json:"Ticker"`
+	Date   string          `json:"Date"`
+	Price  decimal.Decimal `json:"Price"`
+}
+
+type PriceFile struct {
+	Prices []PriceFileEntry `json:"prices"`
+}
+
+type price struct {
+	date  time.Time
+	price decimal.Decimal
+}
+
+// PriceMaxAgeDays is how far before a date the latest price can be to value
+// a holding on that date, to allow for weekends and market holidays
+const PriceMaxAgeDays = 7
+
+type PriceBook interface {
+	// GetPrice returns the latest price on or before the date and the date
+	// of that price, looked up by ISIN and then by ticker
+	GetPrice(isin, ticker string, date time.Time) (decimal.Decimal, time.Time, bool)
+}
+
+type PriceBookStruct struct {
+	prices map[string][]price
+}
+
+func NewPriceBook() PriceBook {
+	return &PriceBookStruct{prices: make(map[string][]price)}
+}
+
+// LoadPriceBook reads the price file at the given path
+func LoadPriceBook(filePath string) (PriceBook, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, merry.Errorf("failed to open price file: %w", err)
+	}
+	defer file.Close()
+
+	priceFile := PriceFile{}
+	err = json.NewDecoder(file).Decode(&priceFile)
+	if err != nil {
+		return nil, merry.Errorf("failed to parse price file: %w", err)
+	}
+
+	priceBook := &PriceBookStruct{prices: make(map[string][]price)}
+	for _, entry := range priceFile.Prices {
+		date, err := time.Parse(time.DateOnly, entry.Date)
+		if err != nil {
+			return nil, merry.Errorf("failed to parse price date '%s': %w", entry.Date, err)
+		}
+
+		for _, key := range []string{entry.Isin, entry.Ticker} {
+			if key == "" {
+				continue
+			}
+			priceBook.prices[key] = append(priceBook.prices[key], price{date: date, price: entry.Price})
+		}
+	}
+
+	for key := range priceBook.prices {
+		slices.SortFunc(priceBook.prices[key], func(first, second price) int {
+			return first.date.Compare(second.date)
+		})
+	}
+	return priceBook, nil
+}
+
+func (p *PriceBookStruct) GetPrice(isin, ticker string, date time.Time) (decimal.Decimal, time.Time, bool) {
+	for _, key := range []string{isin, ticker} {
+		if key == "" {
+			continue
+		}
+
+		prices := p.prices[key]
+		for i := len(prices) - 1; i >= 0; i-- {
+			if !prices[i].date.After(date) {
+				return prices[i].price, prices[i].date, true
+			}
+		}
+	}
+	return decimal.NewFromInt(0), time.Time{}, false
+}
+
+// getRecentPrice returns the latest price on or before the date, unless it is
+// more than PriceMaxAgeDays older than the date. The date of the latest price
+// is returned either way, it is zero if there is no price.
+func getRecentPrice(prices PriceBook, isin, ticker string, date time.Time) (decimal.Decimal, time.Time, bool) {
+	price, priceDate, ok := prices.GetPrice(isin, ticker, date)
+	if !ok || priceDate.AddDate(0, 0, PriceMaxAgeDays).Before(date) {
+		return decimal.NewFromInt(0), priceDate, false
+	}
+	return price, priceDate, true
+}
+
+// formatPriceDate describes the date of the latest price for the logs
+func formatPriceDate(priceDate time.Time) string {
+	if priceDate.IsZero() {
+		return "none"
+	}
+	return fmt.Sprintf("%s, more than %d days before", priceDate.Format(time.DateOnly), PriceMaxAgeDays)
+}
@@ -2,7 +2,7 @@ package trading212
 
 import (
 	"fmt"
-	"strings"
+	"slices"
 	"time"
 
 	"github.com/ansel1/merry/v2"
@@ -17,23 +17,58 @@ type PurchaseHistory interface {
 	GetSaleAggregatesForYear(year int) StockSummary
 	GetLossAggregatesForYear(year int) StockSummary
 	GetProfitAggregatesForYear(year int) StockSummary
+	GetRestrictedLossAggregatesForYear(year int) StockSummary
+	GetSummaryForPeriod(year int, period Period) PeriodSummary
+	GetDisposalsForYear(year int) []Disposal
+	ProcessDeemedDisposals(log logr.Logger, until time.Time, prices PriceBook, rates ExitTaxRates) error
+	GetDeemedDisposalsForYear(year int) []DeemedDisposal
+	GetUpcomingDeemedDisposals(after time.Time, prices PriceBook) []DeemedDisposal
+	ProcessMerger(log logr.Logger, action CorporateAction, newSharePrice decimal.Decimal) ([]*Record, error)
+	ProcessSpinOff(log logr.Logger, action CorporateAction) []*Record
+	AdjustCost(log logr.Logger, adjustment CostAdjustment) error
+	GetCostAdjustments() []CostAdjustment
+	GetDividends() []DividendPayment
+	GetFundDistributions() []DividendPayment
+	GetPendingSplit() *Record
 }
 
 type PurchaseHistoryStruct struct {
-	recordQueue      RecordQueue
-	profits          map[int]StockSummary
-	saleAggregates   map[int]StockSummary
-	lossAggregates   map[int]StockSummary
-	profitAggregates map[int]StockSummary
+	recordQueue RecordQueue
+	// summaries are kept per payment period, the yearly figures are the sum
+	// of both periods
+	profits          map[TaxPeriod]StockSummary
+	saleAggregates   map[TaxPeriod]StockSummary
+	lossAggregates   map[TaxPeriod]StockSummary
+	profitAggregates map[TaxPeriod]StockSummary
+	// losses ring-fenced under s581(3), not part of the lossAggregates
+	restrictedLossAggregates map[TaxPeriod]StockSummary
+	disposals                []*Disposal
+	washSaleCandidates       []*washSaleCandidate
+	deemedDisposals          []*DeemedDisposal
+	// pendingSplit is the first row of a stock split pair waiting for the
+	// other one
+	pendingSplit    *Record
+	costAdjustments []*CostAdjustment
+	dividends       []DividendPayment
+	// fundDistributions are the dividends of funds
+	fundDistributions []DividendPayment
 }
 
 func NewPurchaseHistory(recordQueue RecordQueue) PurchaseHistory {
 	return &PurchaseHistoryStruct{
 		recordQueue:      recordQueue,
-		profits:          make(map[int]StockSummary),
-		saleAggregates:   make(map[int]StockSummary),
-		lossAggregates:   make(map[int]StockSummary),
-		profitAggregates: make(map[int]StockSummary),
+		profits:          make(map[TaxPeriod]StockSummary),
+		saleAggregates:   make(map[TaxPeriod]StockSummary),
+		lossAggregates:   make(map[TaxPeriod]StockSummary),
+		profitAggregates: make(map[TaxPeriod]StockSummary),
+
+		restrictedLossAggregates: make(map[TaxPeriod]StockSummary),
+		disposals:                make([]*Disposal, 0),
+		washSaleCandidates:       make([]*washSaleCandidate, 0),
+		deemedDisposals:          make([]*DeemedDisposal, 0),
+		costAdjustments:          make([]*CostAdjustment, 0),
+		dividends:                make([]DividendPayment, 0),
+		fundDistributions:        make([]DividendPayment, 0),
 	}
 }
 
@@ -42,26 +77,87 @@ func (q *PurchaseHistoryStruct) GetRecordQueue() RecordQueue {
 }
 
 func (q *PurchaseHistoryStruct) GetProfitForYear(year int) StockSummary {
-	return q.profits[year]
+	return sumPeriods(q.profits, year)
 }
 
 func (q *PurchaseHistoryStruct) GetSaleAggregatesForYear(year int) StockSummary {
-	return q.saleAggregates[year]
+	return sumPeriods(q.saleAggregates, year)
 }
 
 func (q *PurchaseHistoryStruct) GetLossAggregatesForYear(year int) StockSummary {
-	return q.lossAggregates[year]
+	return sumPeriods(q.lossAggregates, year)
 }
 
 func (q *PurchaseHistoryStruct) GetProfitAggregatesForYear(year int) StockSummary {
-	return q.profitAggregates[year]
+	return sumPeriods(q.profitAggregates, year)
 }
 
+func (q *PurchaseHistoryStruct) GetRestrictedLossAggregatesForYear(year int) StockSummary {
+	return sumPeriods(q.restrictedLossAggregates, year)
+}
+
+func (q *PurchaseHistoryStruct) GetSummaryForPeriod(year int, period Period) PeriodSummary {
+	taxPeriod := TaxPeriod{Year: year, Period: period}
+	return PeriodSummary{
+		Profits:                  q.profits[taxPeriod],
+		SaleAggregates:           q.saleAggregates[taxPeriod],
+		LossAggregates:           q.lossAggregates[taxPeriod],
+		ProfitAggregates:         q.profitAggregates[taxPeriod],
+		RestrictedLossAggregates: q.restrictedLossAggregates[taxPeriod],
+	}
+}
+
+func (q *PurchaseHistoryStruct) GetDisposalsForYear(year int) []Disposal {
+	disposals := []Disposal{}
+	for _, disposal := range q.disposals {
+		if disposal.GetYear() == year {
+			disposals = append(disposals, *disposal)
+		}
+	}
+	return disposals
+}
+
+// Process sends the record to the handler of its kind of action
 func (q *PurchaseHistoryStruct) Process(log logr.Logger, newRecord *Record) error {
-	if !strings.Contains(newRecord.Action, "buy") && !strings.Contains(newRecord.Action, "sell") {
-		return nil
+	switch newRecord.Action.GetKind() {
+	case BuyKind:
+		return q.processBuy(log, newRecord)
+	case SellKind:
+		return q.processSell(log, newRecord)
+	case StockSplitKind:
+		err := q.processStockSplit(log, newRecord)
+		if err != nil {
+			return merry.Errorf("failed to process stock split: %w", err)
+		}
+	case ReturnOfCapitalKind:
+		err := q.AdjustCost(log, NewCostAdjustment(*newRecord))
+		if err != nil {
+			return merry.Errorf("failed to adjust cost: %w", err)
+		}
+	case DividendKind:
+		err := q.processDividend(log, newRecord)
+		if err != nil {
+			return merry.Errorf("failed to process dividend: %w", err)
+		}
+	case CashKind:
+		// they do not change the shares held or their cost
+		log.V(1).Info("not a disposal or acquisition",
+			"action", newRecord.Action,
+			"id", newRecord.ID,
+			"ticker", newRecord.Ticker,
+		)
+	default:
+		// unknown actions are read in lenient mode only, where they are
+		// reported as bad values
+		log.V(0).Info("WARNING: record with an unknown action is ignored",
+			"id", newRecord.ID,
+			"time", newRecord.Time,
+		)
 	}
+	return nil
+}
 
+func (q *PurchaseHistoryStruct) logRecord(log logr.Logger, newRecord *Record) {
 	log.V(1).Info(fmt.Sprintf("%-12s", newRecord.Action),
 		"ticker", fmt.Sprintf("%-5s", newRecord.Ticker),
 		"date", newRecord.Time.String(),
@@ -69,55 +165,94 @@ func (q *PurchaseHistoryStruct) Process(log logr.Logger, newRecord *Record) erro
 		"NoOfShares", fmt.Sprintf("%6s", newRecord.NoOfShares.StringFixed(2)),
 		"splitadjusted", fmt.Sprintf("%-5t", newRecord.SplitAdjusted.Done),
 	)
-	if strings.Contains(newRecord.Action, "buy") {
-		q.recordQueue.Append(newRecord)
-	} else if strings.Contains(newRecord.Action, "sell") {
-		year := newRecord.GetYear()
-		sellPrice, profit, err := q.updateHistoryAndGetProfit(log, *newRecord)
-		if err != nil {
-			return merry.Errorf("failed to process new record: %w", err)
-		}
+}
 
-		existingYearProfit := q.profits[year]
-		existingYearSaleAggregate := q.saleAggregates[year]
-		existingYearLossAggregate := q.lossAggregates[year]
-		existingYearProfitAggregate := q.profitAggregates[year]
-
-		newRecordType := newRecord.GetType()
-		switch newRecordType {
-		case Stock:
-			existingYearProfit.Stock = existingYearProfit.Stock.Add(profit)
-			q.profits[year] = existingYearProfit
-			existingYearSaleAggregate.Stock = existingYearSaleAggregate.Stock.Add(sellPrice)
-			q.saleAggregates[year] = existingYearSaleAggregate
-			if profit.LessThan(decimal.NewFromInt(0)) {
-				existingYearLossAggregate.Stock = existingYearLossAggregate.Stock.Add(profit)
-				q.lossAggregates[year] = existingYearLossAggregate
-			} else {
-				existingYearProfitAggregate.Stock = existingYearProfitAggregate.Stock.Add(profit)
-				q.profitAggregates[year] = existingYearProfitAggregate
-			}
-		case ETF:
-			existingYearProfit.ETF = existingYearProfit.ETF.Add(profit)
-			q.profits[year] = existingYearProfit
-			existingYearSaleAggregate.ETF = existingYearSaleAggregate.ETF.Add(sellPrice)
-			q.saleAggregates[year] = existingYearSaleAggregate
-			if profit.LessThan(decimal.NewFromInt(0)) {
-				existingYearLossAggregate.ETF = existingYearLossAggregate.ETF.Add(profit)
-				q.lossAggregates[year] = existingYearLossAggregate
-			} else {
-				existingYearProfitAggregate.ETF = existingYearProfitAggregate.ETF.Add(profit)
-				q.profitAggregates[year] = existingYearProfitAggregate
-			}
-		default:
-			return merry.Errorf("invalid record type: %s", newRecordType)
+func (q *PurchaseHistoryStruct) processBuy(log logr.Logger, newRecord *Record) error {
+	q.logRecord(log, newRecord)
+	q.recordQueue.Append(newRecord)
 
-		}
+	err := q.ringFenceLosses(log, newRecord)
+	if err != nil {
+		return merry.Errorf("failed to ring-fence losses: %w", err)
+	}
+	return nil
+}
+
+func (q *PurchaseHistoryStruct) processSell(log logr.Logger, newRecord *Record) error {
+	q.logRecord(log, newRecord)
+	disposal, err := q.updateHistoryAndGetDisposal(log, *newRecord)
+	if err != nil {
+		return merry.Errorf("failed to process new record: %w", err)
 	}
 
+	err = q.recordDisposal(disposal)
+	if err != nil {
+		return merry.Errorf("failed to record disposal: %w", err)
+	}
 	return nil
 }
 
+// recordDisposal adds the disposal to the ledger and to the yearly summaries
+func (q *PurchaseHistoryStruct) recordDisposal(disposal *Disposal) error {
+	taxPeriod := GetTaxPeriod(disposal.Date)
+	profit := disposal.GetChargeableProfit()
+
+	err := addToSummary(q.profits, taxPeriod, disposal.Type, profit)
+	if err != nil {
+		return err
+	}
+	err = addToSummary(q.saleAggregates, taxPeriod, disposal.Type, disposal.Proceeds)
+	if err != nil {
+		return err
+	}
+	if profit.LessThan(decimal.NewFromInt(0)) {
+		err = addToSummary(q.lossAggregates, taxPeriod, disposal.Type, profit)
+	} else {
+		err = addToSummary(q.profitAggregates, taxPeriod, disposal.Type, profit)
+	}
+	if err != nil {
+		return err
+	}
+
+	q.disposals = append(q.disposals, disposal)
+
+	if disposal.Profit.LessThan(decimal.NewFromInt(0)) {
+		q.washSaleCandidates = append(q.washSaleCandidates, &washSaleCandidate{
+			disposal:  disposal,
+			quantity:  disposal.Quantity,
+			unmatched: disposal.Quantity,
+		})
+	}
+	return nil
+}
+
+// addToSummary adds the value to the period's summary under the given type
+func addToSummary(summaries map[TaxPeriod]StockSummary, taxPeriod TaxPeriod,
+	recordType RecordType, value decimal.Decimal) error {
+	summary := summaries[taxPeriod]
+	switch recordType {
+	case Stock:
+		summary.Stock = summary.Stock.Add(value)
+	case ETF:
+		summary.ETF = summary.ETF.Add(value)
+	default:
+		return merry.Errorf("invalid record type: %s", recordType)
+	}
+	summaries[taxPeriod] = summary
+	return nil
+}
+
+// sumPeriods adds up the summaries of every period in the year
+func sumPeriods(summaries map[TaxPeriod]StockSummary, year int) StockSummary {
+	summary := StockSummary{}
+	for _, period := range Periods {
+		periodSummary := summaries[TaxPeriod{Year: year, Period: period}]
+		summary.Stock = summary.Stock.Add(periodSummary.Stock)
+		summary.ETF = summary.ETF.Add(periodSummary.ETF)
+	}
+	return summary
+}
+
 func TimeIsBetween(t, min, max time.Time) bool {
 	if min.After(max) {
 		min, max = max, min
@@ -125,26 +260,82 @@ func TimeIsBetween(t, min, max time.Time) bool {
 	return (t.Equal(min) || t.After(min)) && (t.Equal(max) || t.Before(max))
 }
 
-// FIFO default
-// If sold withing 4 weeks of purchase, LIFO will apply when needed
+// identifiedLot is an open acquisition lot along with the identification
+// rule it was picked up under
+type identifiedLot struct {
+	record *Record
+	method MatchMethod
+}
+
+// identifyLots orders the open lots in the order they are matched against a
+// disposal on the given date, following s581 TCA 1997:
+//   - shares acquired within the 4 weeks preceding the disposal are
+//     identified first, newest first (LIFO, s581(1))
+//   - the excess is identified with the older acquisitions, oldest first
+//     (FIFO, s581(2))
+//
+// Lots acquired after the disposal cannot be matched against it.
+func (q *PurchaseHistoryStruct) identifyLots(disposalTime time.Time) []identifiedLot {
+	windowStart := disposalTime.AddDate(0, 0, -7*4)
+
+	recent := []*Record{}
+	older := []*Record{}
+	for _, record := range q.recordQueue.GetQueue() {
+		if record.Time.After(disposalTime) {
+			continue
+		}
+		if TimeIsBetween(record.Time, windowStart, disposalTime) {
+			recent = append(recent, record)
+		} else {
+			older = append(older, record)
+		}
+	}
+
+	// stable sorts keep the queue order for lots acquired at the same instant
+	slices.SortStableFunc(recent, func(first, second *Record) int {
+		return second.Time.Compare(first.Time)
+	})
+	slices.SortStableFunc(older, func(first, second *Record) int {
+		return first.Time.Compare(second.Time)
+	})
+
+	lots := make([]identifiedLot, 0, len(recent)+len(older))
+	for _, record := range recent {
+		lots = append(lots, identifiedLot{record: record, method: LIFO})
+	}
+	for _, record := range older {
+		lots = append(lots, identifiedLot{record: record, method: FIFO})
+	}
+	return lots
+}
+
+// updateHistoryAndGetDisposal matches the sell against the open lots as
+// ordered by identifyLots and consumes them.
 // If bought within 4 weeks of sale, if a loss occurs on the initial disposal,
 // then this loss can only be offset against a gain on the sale of shares of
 // the same class which were purchased within 4 weeks of that sale.
-func (q *PurchaseHistoryStruct) updateHistoryAndGetProfit(
-	log logr.Logger, sellRecord Record) (decimal.Decimal, decimal.Decimal, error) {
-	var buyPrice, sellPrice, profit, totalSale decimal.Decimal
-	var err error
-
-	for !sellRecord.NoOfShares.Equal(decimal.NewFromInt(0)) {
-		if q.recordQueue.Size() <= 0 {
-			return sellPrice, profit, merry.Errorf("not enough shares available to sell: %s", sellRecord.Ticker)
+func (q *PurchaseHistoryStruct) updateHistoryAndGetDisposal(
+	log logr.Logger, sellRecord Record) (*Disposal, error) {
+	disposal := NewDisposal(sellRecord)
+
+	lots := q.identifyLots(sellRecord.Time)
+
+	available := decimal.NewFromInt(0)
+	for _, lot := range lots {
+		available = available.Add(lot.record.NoOfShares)
+	}
+	if available.LessThan(sellRecord.NoOfShares) {
+		return disposal, merry.Errorf("not enough shares available to sell: %s: requested %s, available %s",
+			sellRecord.Ticker, sellRecord.NoOfShares.String(), available.String())
+	}
+
+	for _, lot := range lots {
+		if sellRecord.NoOfShares.LessThanOrEqual(decimal.NewFromInt(0)) {
+			break
 		}
+		buyRecord := lot.record
 
-		buyRecord := q.recordQueue.Peek(0)
-		lastRecord := q.recordQueue.Peek(q.recordQueue.Size() - 1)
-		if TimeIsBetween(lastRecord.Time, sellRecord.Time.AddDate(0, 0, -7*4), sellRecord.Time) {
-			// Fits the bill for LIFO
-			buyRecord = lastRecord
+		if lot.method == LIFO {
 			log.V(2).Info("LIFO processing...",
 				"buyRecord", buyRecord,
 				"sellRecord", sellRecord)
@@ -162,65 +353,59 @@ func (q *PurchaseHistoryStruct) updateHistoryAndGetProfit(
 				"old", buyRecord.ExchangeRate,
 				"new", buyExchangeRateOverride)
 		}
+		buyExchangeRate := *buyExchangeRateOverride
 
-		if sellRecord.NoOfShares.LessThan(buyRecord.NoOfShares) {
-			// more shares available than to sell
-
-			logBuyRecordShareCount := buyRecord.NoOfShares
-			buyPrice, err = buyRecord.GetActualPriceForQuantity(
-				sellRecord.NoOfShares, buyExchangeRateOverride, true)
-			if err != nil {
-				return sellPrice, profit, merry.Errorf("failed to get buy price for sell action: %w", err)
-			}
-
-			logSellRecordShareCount := sellRecord.NoOfShares
-			// get price of sale action
-			sellPrice, err = sellRecord.GetActualPriceForQuantity(
-				sellRecord.NoOfShares, nil, false)
-			if err != nil {
-				return sellPrice, profit, merry.Errorf("failed to get sell price for sell action: %w", err)
-			}
-
-			log.V(3).Info("sold buy record partially",
-				"initialBuy", logBuyRecordShareCount.String(),
-				"sold", logSellRecordShareCount.String(),
-				"leftBuy", buyRecord.NoOfShares.String(),
-				"calculated buy record price", buyPrice.String(),
-				"calculated sell record price", sellPrice.String())
-
-			sellRecord.NoOfShares = decimal.NewFromInt(0)
+		quantity := decimal.Min(sellRecord.NoOfShares, buyRecord.NoOfShares)
+		buyQuantity := buyRecord.NoOfShares
+		buyFees := buyRecord.GetProportionalConversionFee(quantity)
+		deemedDisposalCredit := buyRecord.DeemedDisposalTaxPerShare.Mul(quantity)
+		sellFees := sellRecord.GetProportionalConversionFee(quantity)
 
-		} else {
-			// get the profit from the sale for the number of shares you bought above
-			logSellRecordShareCount := sellRecord.NoOfShares
-			sellPrice, err = sellRecord.GetActualPriceForQuantity(
-				buyRecord.NoOfShares, nil, false)
-			if err != nil {
-				return sellPrice, profit, merry.Errorf("failed to get price for sell action: %w", err)
-			}
-
-			// sell off all stocks in this "buy record" to get the "buy price" at market value
-			logBuyRecordShareCount := buyRecord.NoOfShares
-			buyPrice, err = buyRecord.GetActualPriceForQuantity(
-				buyRecord.NoOfShares, buyExchangeRateOverride, true)
-			if err != nil {
-				return sellPrice, profit, merry.Errorf("failed to get price for sell action: %w", err)
-			}
-
-			log.V(3).Info("sold buy record fully",
-				"initialToSell", logSellRecordShareCount.String(),
-				"sold", logBuyRecordShareCount.String(),
-				"leftToSell", sellRecord.NoOfShares.String(),
-				"calculated buy record price", buyPrice.String(),
-				"calculated sell record price", sellPrice.String())
+		logSellRecordShareCount := sellRecord.NoOfShares
+
+		sellPrice, err := sellRecord.GetActualPriceForQuantity(quantity, nil, false)
+		if err != nil {
+			return disposal, merry.Errorf("failed to get sell price for sell action: %w", err)
 		}
-		totalSale = totalSale.Add(sellPrice)
-		profit = profit.Add(sellPrice.Sub(buyPrice))
+
+		buyPrice, err := buyRecord.GetActualPriceForQuantity(quantity, &buyExchangeRate, true)
+		if err != nil {
+			return disposal, merry.Errorf("failed to get buy price for sell action: %w", err)
+		}
+
+		used, forfeited := releaseRingFencedLoss(buyRecord, buyQuantity, quantity, sellPrice.Sub(buyPrice))
+		disposal.RingFencedLossForfeited = disposal.RingFencedLossForfeited.Add(forfeited)
+
+		log.V(3).Info("matched buy record",
+			"method", lot.method,
+			"initialBuy", buyQuantity.String(),
+			"initialToSell", logSellRecordShareCount.String(),
+			"sold", quantity.String(),
+			"leftBuy", buyRecord.NoOfShares.String(),
+			"leftToSell", sellRecord.NoOfShares.String(),
+			"calculated buy record price", buyPrice.String(),
+			"calculated sell record price", sellPrice.String())
+
+		disposal.AddLot(DisposalLot{
+			BuyID:        buyRecord.ID,
+			BuyDate:      buyRecord.Time,
+			Quantity:     quantity,
+			Cost:         buyPrice,
+			Proceeds:     sellPrice,
+			BuyFees:      buyFees,
+			SellFees:     sellFees,
+			ExchangeRate: buyExchangeRate,
+			Method:       lot.method,
+
+			RingFencedLossUsed:   used,
+			DeemedDisposalCredit: deemedDisposalCredit,
+			ManualReason:         buyRecord.ManualReason,
+		})
 
 		log.V(2).Info("interim data",
-			"sale", totalSale.String(),
+			"sale", disposal.Proceeds.String(),
 			"interimProfit", sellPrice.Sub(buyPrice),
-			"transactionCumulativeProfit", profit.String())
+			"transactionCumulativeProfit", disposal.Profit.String())
 
 		if buyRecord.NoOfShares.LessThanOrEqual(decimal.NewFromInt(0)) {
 			// get rid of record if it has no shares in it
@@ -230,7 +415,7 @@ func (q *PurchaseHistoryStruct) updateHistoryAndGetProfit(
 	}
 
 	log.V(1).Info("transaction result data",
-		"sale", totalSale.String(),
-		"profit", profit.String())
-	return totalSale, profit, nil
+		"sale", disposal.Proceeds.String(),
+		"profit", disposal.Profit.String())
+	return disposal, nil
 }
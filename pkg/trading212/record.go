@@ -1,35 +1,39 @@
 package trading212
 
 import (
-	"slices"
 	"time"
 
 	"github.com/ansel1/merry/v2"
 	"github.com/shopspring/decimal"
 )
 
+// RecordDTO holds the values of a row of a history file as read
 type RecordDTO struct {
-	Action                        string `json:"Action"`
-	Time                          string `json:"Time"`
-	Isin                          string `json:"ISIN"`
-	Ticker                        string `json:"Ticker"`
-	Name                          string `json:"Name"`
-	NoOfShares                    string `json:"No. of shares"`
-	PriceShare                    string `json:"Price / share"`
-	CurrencyPriceShare            string `json:"Currency (Price / share)"`
-	ExchangeRate                  string `json:"Exchange rate"`
-	Result                        string `json:"Result"`
-	CurrencyResult                string `json:"Currency (Result)"`
-	Total                         string `json:"Total"`
-	CurrencyTotal                 string `json:"Currency (Total)"`
-	WithholdingTax                string `json:"Withholding tax"`
-	CurrencyWithholdingTax        string `json:"Currency (Withholding tax)"`
-	StampDutyReserveTax           string `json:"Stamp duty reserve tax"`
-	CurrencyStampDutyReserveTax   string `json:"Currency (Stamp duty reserve tax)"`
-	Notes                         string `json:"Notes"`
-	ID                            string `json:"ID"`
-	CurrencyConversionFee         string `json:"Currency conversion fee"`
-	CurrencyCurrencyConversionFee string `json:"Currency (Currency conversion fee)"`
+	Action                        string
+	Time                          string
+	Isin                          string
+	Ticker                        string
+	Name                          string
+	NoOfShares                    string
+	PriceShare                    string
+	CurrencyPriceShare            string
+	ExchangeRate                  string
+	Result                        string
+	CurrencyResult                string
+	Total                         string
+	CurrencyTotal                 string
+	WithholdingTax                string
+	CurrencyWithholdingTax        string
+	StampDutyReserveTax           string
+	CurrencyStampDutyReserveTax   string
+	Notes                         string
+	ID                            string
+	CurrencyConversionFee         string
+	CurrencyCurrencyConversionFee string
+
+	// Extra holds the values of the columns that are not mapped to a field,
+	// by header
+	Extra map[string]string
 }
 
 type SplitAdjusted struct {
@@ -39,7 +43,7 @@ type SplitAdjusted struct {
 type Record struct {
 	SplitAdjusted
 
-	Action                        string          `json:"Action"`
+	Action                        Action          `json:"Action"`
 	Time                          time.Time       `json:"Time"`
 	Isin                          string          `json:"ISIN"`
 	Ticker                        string          `json:"Ticker"`
@@ -60,6 +64,31 @@ type Record struct {
 	ID                            string          `json:"ID"`
 	CurrencyConversionFee         decimal.Decimal `json:"Currency conversion fee"`
 	CurrencyCurrencyConversionFee string          `json:"Currency (Currency conversion fee)"`
+
+	// RingFencedLoss is the loss from an earlier disposal that can only be
+	// offset against a gain on the shares of this lot (s581(3))
+	RingFencedLoss decimal.Decimal `json:"-"`
+	// DeemedDisposalCount is the number of 8 year anniversaries of the lot
+	// that were processed
+	DeemedDisposalCount int `json:"-"`
+	// UnpricedDeemedDisposal is the anniversary of the lot that is pending
+	// as there was no price for it
+	UnpricedDeemedDisposal time.Time `json:"-"`
+	// DeemedDisposalTaxPerShare is the exit tax paid on deemed disposals of
+	// the lot, credited against the real disposal
+	DeemedDisposalTaxPerShare decimal.Decimal `json:"-"`
+	// AssetClass is set from the classification registry when the record is
+	// processed
+	AssetClass AssetClass `json:"-"`
+	// ManualReason is set for the records from the manual transactions file
+	ManualReason string `json:"-"`
+	// Extra holds the values of the columns of the history file that are not
+	// mapped to a field, by header
+	Extra map[string]string `json:"-"`
+	// Source is the file the record was read from and Line its line in it,
+	// 0 for the files that are not CSV
+	Source string `json:"-"`
+	Line   int    `json:"-"`
 }
 
 type RecordType string
@@ -78,7 +107,7 @@ func (r *Record) GetActualPriceForQuantity(quantity decimal.Decimal,
 			merry.Errorf("quantity value is more than available shares: Requested: %f Available: %f",
 				quantity, r.NoOfShares)
 	}
-	proportionalConversionFee := r.CurrencyConversionFee.Mul(quantity).Div(r.NoOfShares)
+	proportionalConversionFee := r.GetProportionalConversionFee(quantity)
 
 	er := r.ExchangeRate
 	if conversionOverride != nil {
@@ -106,165 +135,67 @@ func (r *Record) GetActualPriceForQuantity(quantity decimal.Decimal,
 	return total, nil
 }
 
+// GetProportionalConversionFee returns the share of the currency conversion
+// fee attributable to the given quantity
+func (r *Record) GetProportionalConversionFee(quantity decimal.Decimal) decimal.Decimal {
+	if r.NoOfShares.IsZero() {
+		return decimal.NewFromInt(0)
+	}
+	return r.CurrencyConversionFee.Mul(quantity).Div(r.NoOfShares)
+}
+
+// GetCost returns the cost in EUR of the shares left in the record, including
+// the fees
+func (r *Record) GetCost() decimal.Decimal {
+	if r.ExchangeRate.IsZero() {
+		return r.CurrencyConversionFee
+	}
+	return r.NoOfShares.Mul(r.PriceShare).Div(r.ExchangeRate).Add(r.CurrencyConversionFee)
+}
+
 func (r *Record) GetYear() int {
 	return r.Time.Year()
 }
 
 // I have a support ticket with Trading 212 to add this data
-// to the transaction history export
+// to the transaction history export, until then it comes from the
+// classification registry
 func (r *Record) GetType() RecordType {
-	etf := []string{"VUSA", "VUAA"}
-
-	if slices.Contains(etf, r.Ticker) {
-		return ETF
-	}
-	return Stock
+	return r.AssetClass.GetRecordType()
 }
 
-func (r *Record) AdjustForSplit() error {
-	_, denominator := SplitAdjustmentRequired(*r)
-
-	if denominator == 1 { // no adjustment needed
-		return nil
+// AdjustForSplit restates the record in the shares after the split, keeping
+// its total value
+func (r *Record) AdjustForSplit(action CorporateAction) error {
+	if !action.IsSplit() {
+		return merry.Errorf("%s is not a split", action.Type)
 	}
 
-	r.NoOfShares = r.NoOfShares.Mul(decimal.NewFromInt(denominator))
-	r.PriceShare = r.PriceShare.Div(decimal.NewFromInt(denominator))
+	r.NoOfShares = r.NoOfShares.Mul(action.To).Div(action.From)
+	r.PriceShare = r.PriceShare.Mul(action.From).Div(action.To)
 	r.SplitAdjusted.Done = true
 
 	return nil
 }
 
-func SplitAdjustmentRequired(record Record) (numerator, dedenmoniator int64) {
-	// https://companiesmarketcap.com/eur
+// ScaleCost multiplies the cost of the record by the factor, keeping its
+// quantity
+func (r *Record) ScaleCost(factor decimal.Decimal) {
+	r.PriceShare = r.PriceShare.Mul(factor)
+	r.CurrencyConversionFee = r.CurrencyConversionFee.Mul(factor)
+	r.Total = r.Total.Mul(factor)
+}
 
-	if record.Ticker == "AAPL" {
-		// all good for post 2022
-		return 1, 1
-	}
-	if record.Ticker == "AMD" {
-		// all good for post 2022
-		return 1, 1
-	}
-	if record.Ticker == "AMZN" &&
-		record.Time.Before(time.Date(2022, 6, 6, 0, 0, 0, 0, time.UTC)) &&
-		record.Time.After(time.Date(1999, 9, 2, 0, 0, 0, 0, time.UTC)) {
-		return 1, 20
-	}
-	if record.Ticker == "BA" {
-		// all good for post 2022
-		return 1, 1
-	}
-	if record.Ticker == "BABA" {
-		// all good for post 2022
-		return 1, 1
-	}
-	if record.Ticker == "BARC" {
-		// all good for post 2022
-		return 1, 1
-	}
-	if record.Ticker == "BRT3" {
-		// ETF
-		return 1, 1
-	}
-	if record.Ticker == "CRUDP" {
-		// idk
-		return 1, 1
-	}
-	if record.Ticker == "CRWD" {
-		// all good for post 2022
-		return 1, 1
-	}
-	if record.Ticker == "DIS" {
-		// all good for post 2022
-		return 1, 1
-	}
-	if record.Ticker == "GME" &&
-		record.Time.Before(time.Date(2022, 7, 22, 0, 0, 0, 0, time.UTC)) &&
-		record.Time.After(time.Date(2007, 3, 19, 0, 0, 0, 0, time.UTC)) {
-		return 1, 4
+// ApplyCorporateAction restates the record to the terms in force after the
+// action
+func (r *Record) ApplyCorporateAction(action CorporateAction) error {
+	switch action.Type {
+	case TickerChange:
+		r.Ticker = action.NewTicker
+	case IsinChange:
+		r.Isin = action.NewIsin
+	default:
+		return r.AdjustForSplit(action)
 	}
-	if record.Ticker == "GOOGL" &&
-		record.Time.Before(time.Date(2022, 7, 18, 0, 0, 0, 0, time.UTC)) &&
-		record.Time.After(time.Date(2015, 4, 27, 0, 0, 0, 0, time.UTC)) {
-		return 1, 20
-	}
-	if record.Ticker == "INTC" {
-		// all good for post 2022
-		return 1, 1
-	}
-	if record.Ticker == "LUNR" {
-		// all good for post 2022
-		return 1, 1
-	}
-	if record.Ticker == "META" {
-		// all good for post 2022
-		return 1, 1
-	}
-	if record.Ticker == "MRNA" {
-		// all good for post 2022
-		return 1, 1
-	}
-	if record.Ticker == "MSFT" {
-		// all good for post 2022
-		return 1, 1
-	}
-	if record.Ticker == "NFLX" {
-		// all good for post 2022
-		return 1, 1
-	}
-	if record.Ticker == "NKE" {
-		// all good for post 2022
-		return 1, 1
-	}
-	if record.Ticker == "NVDA" &&
-		record.Time.Before(time.Date(2024, 6, 10, 0, 0, 0, 0, time.UTC)) &&
-		record.Time.After(time.Date(2021, 7, 20, 0, 0, 0, 0, time.UTC)) {
-		return 1, 10
-	}
-	if record.Ticker == "RACE" {
-		// all good for post 2022
-		return 1, 1
-	}
-	if record.Ticker == "RIGD" {
-		// all good for post 2022
-		return 1, 1
-	}
-	if record.Ticker == "RR" {
-		// all good for post 2022
-		return 1, 1
-	}
-	if record.Ticker == "RS" {
-		// all good for post 2022
-		return 1, 1
-	}
-	if record.Ticker == "SPCE" &&
-		record.Time.Before(time.Date(2024, 6, 17, 0, 0, 0, 0, time.UTC)) {
-		// all good for post 2022
-		return 1, 20
-	}
-	if record.Ticker == "SPOT" {
-		// all good for post 2022
-		return 1, 1
-	}
-	if record.Ticker == "TSLA" &&
-		record.Time.Before(time.Date(2022, 8, 25, 0, 0, 0, 0, time.UTC)) &&
-		record.Time.After(time.Date(2020, 8, 31, 0, 0, 0, 0, time.UTC)) {
-		return 1, 3
-	}
-	if record.Ticker == "TWTR" {
-		// all good for post 2022
-		return 1, 1
-	}
-	if record.Ticker == "VUAA" {
-		// ETF
-		return 1, 1
-	}
-	if record.Ticker == "VUSA" {
-		// ETF
-		return 1, 1
-	}
-
-	// Unknown
-	return 1, 1
+	return nil
 }
@@ -1,7 +1,5 @@
 package trading212
 
-import "reflect"
-
 type RecordQueue interface {
 	Append(rec *Record)
 	Remove(index int) *Record
@@ -32,10 +30,12 @@ func (q *RecordQueueStruct) Remove(index int) *Record {
 	return removed
 }
 
+// RemoveItem removes the given record from the queue. Records are compared by
+// identity so that identical lots are not removed together.
 func (q *RecordQueueStruct) RemoveItem(record *Record) *Record {
 	newData := []*Record{}
 	for _, oldRecord := range q.data {
-		if reflect.DeepEqual(record, oldRecord) {
+		if record == oldRecord {
 			continue
 		}
 		newData = append(newData, oldRecord)
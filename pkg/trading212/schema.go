@@ -0,0 +1,229 @@
+package trading212
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/ansel1/merry/v2"
+)
+
+// SchemaVersion is the layout of the history file detected from its header
+type SchemaVersion string
+
+const (
+	// LegacySchema has the account currency in the header of the amount
+	// columns, e.g. "Total (EUR)"
+	LegacySchema SchemaVersion = "legacy"
+	// CurrencyColumnsSchema has a "Currency (...)" column next to every
+	// amount column
+	CurrencyColumnsSchema SchemaVersion = "currency-columns"
+)
+
+type column struct {
+	// aliases are the normalised headers the column is known by, the first
+	// one is the name used by Trading 212 today
+	aliases []string
+	set     func(dto *RecordDTO, value string)
+	// setCurrency sets the currency of an amount column from its header, for
+	// the legacy schema
+	setCurrency func(dto *RecordDTO, currency string)
+}
+
+var columns = []column{
+	{aliases: []string{"action"}, set: func(dto *RecordDTO, value string) { dto.Action = value }},
+	{aliases: []string{"time", "date"}, set: func(dto *RecordDTO, value string) { dto.Time = value }},
+	{aliases: []string{"isin"}, set: func(dto *RecordDTO, value string) { dto.Isin = value }},
+	{aliases: []string{"ticker", "symbol"}, set: func(dto *RecordDTO, value string) { dto.Ticker = value }},
+	{aliases: []string{"name", "instrument"}, set: func(dto *RecordDTO, value string) { dto.Name = value }},
+	{
+		aliases: []string{"no. of shares", "quantity", "shares"},
+		set:     func(dto *RecordDTO, value string) { dto.NoOfShares = value },
+	},
+	{
+		aliases:     []string{"price / share", "price per share"},
+		set:         func(dto *RecordDTO, value string) { dto.PriceShare = value },
+		setCurrency: func(dto *RecordDTO, currency string) { dto.CurrencyPriceShare = currency },
+	},
+	{
+		aliases: []string{"currency (price / share)"},
+		set:     func(dto *RecordDTO, value string) { dto.CurrencyPriceShare = value },
+	},
+	{
+		aliases: []string{"exchange rate", "fx rate"},
+		set:     func(dto *RecordDTO, value string) { dto.ExchangeRate = value },
+	},
+	{
+		aliases:     []string{"result"},
+		set:         func(dto *RecordDTO, value string) { dto.Result = value },
+		setCurrency: func(dto *RecordDTO, currency string) { dto.CurrencyResult = currency },
+	},
+	{
+		aliases: []string{"currency (result)"},
+		set:     func(dto *RecordDTO, value string) { dto.CurrencyResult = value },
+	},
+	{
+		aliases:     []string{"total"},
+		set:         func(dto *RecordDTO, value string) { dto.Total = value },
+		setCurrency: func(dto *RecordDTO, currency string) { dto.CurrencyTotal = currency },
+	},
+	{
+		aliases: []string{"currency (total)"},
+		set:     func(dto *RecordDTO, value string) { dto.CurrencyTotal = value },
+	},
+	{
+		aliases:     []string{"withholding tax"},
+		set:         func(dto *RecordDTO, value string) { dto.WithholdingTax = value },
+		setCurrency: func(dto *RecordDTO, currency string) { dto.CurrencyWithholdingTax = currency },
+	},
+	{
+		aliases: []string{"currency (withholding tax)"},
+		set:     func(dto *RecordDTO, value string) { dto.CurrencyWithholdingTax = value },
+	},
+	{
+		aliases:     []string{"stamp duty reserve tax", "stamp duty"},
+		set:         func(dto *RecordDTO, value string) { dto.StampDutyReserveTax = value },
+		setCurrency: func(dto *RecordDTO, currency string) { dto.CurrencyStampDutyReserveTax = currency },
+	},
+	{
+		aliases: []string{"currency (stamp duty reserve tax)", "currency (stamp duty)"},
+		set:     func(dto *RecordDTO, value string) { dto.CurrencyStampDutyReserveTax = value },
+	},
+	{aliases: []string{"notes"}, set: func(dto *RecordDTO, value string) { dto.Notes = value }},
+	{aliases: []string{"id", "transaction id"}, set: func(dto *RecordDTO, value string) { dto.ID = value }},
+	{
+		aliases:     []string{"currency conversion fee"},
+		set:         func(dto *RecordDTO, value string) { dto.CurrencyConversionFee = value },
+		setCurrency: func(dto *RecordDTO, currency string) { dto.CurrencyCurrencyConversionFee = currency },
+	},
+	{
+		aliases: []string{"currency (currency conversion fee)"},
+		set:     func(dto *RecordDTO, value string) { dto.CurrencyCurrencyConversionFee = value },
+	},
+}
+
+// requiredColumns are the columns every history file must have
+var requiredColumns = []string{"action", "time"}
+
+// currencyHeaderRegex matches the amount headers of the legacy schema, e.g.
+// "total (eur)"
+var currencyHeaderRegex = regexp.MustCompile(`^(.+?)\s*\(([a-z]{3})\)$`)
+
+// columnMapping is what a column of the file is read into
+type columnMapping struct {
+	column *column
+	// currency is set for the amount columns of the legacy schema
+	currency string
+	// extra is the header of a column that is not known, kept in the
+	// Extra map of the record
+	extra string
+}
+
+// ColumnMapping maps the columns of a history file to the record fields
+type ColumnMapping struct {
+	Schema SchemaVersion
+	// ExtraColumns are the headers that are not mapped to a field
+	ExtraColumns []string
+
+	mappings []columnMapping
+	indexes  map[*column]int
+}
+
+func normaliseHeader(header string) string {
+	header = strings.TrimPrefix(header, "\ufeff")
+	return strings.ToLower(strings.Join(strings.Fields(header), " "))
+}
+
+func findColumn(alias string) *column {
+	for i := range columns {
+		for _, columnAlias := range columns[i].aliases {
+			if columnAlias == alias {
+				return &columns[i]
+			}
+		}
+	}
+	return nil
+}
+
+// NewColumnMapping maps the header of a history file through the alias
+// table, detecting the schema from the headers found
+func NewColumnMapping(header []string) (ColumnMapping, error) {
+	mapping := ColumnMapping{Schema: CurrencyColumnsSchema, indexes: map[*column]int{}}
+	mappedBy := map[*column]string{}
+
+	for i, rawHeader := range header {
+		normalised := normaliseHeader(rawHeader)
+
+		found := findColumn(normalised)
+		currency := ""
+		if found == nil {
+			matches := currencyHeaderRegex.FindStringSubmatch(normalised)
+			if matches != nil {
+				found = findColumn(matches[1])
+				currency = strings.ToUpper(matches[2])
+			}
+			if found != nil && found.setCurrency == nil {
+				found = nil
+			}
+		}
+
+		if found == nil {
+			extra := strings.TrimSpace(strings.TrimPrefix(rawHeader, "\ufeff"))
+			mapping.ExtraColumns = append(mapping.ExtraColumns, extra)
+			mapping.mappings = append(mapping.mappings, columnMapping{extra: extra})
+			continue
+		}
+
+		if previous, ok := mappedBy[found]; ok {
+			return mapping, merry.Errorf("columns '%s' and '%s' are both read as '%s'",
+				previous, rawHeader, found.aliases[0])
+		}
+		mappedBy[found] = rawHeader
+		mapping.indexes[found] = i
+		if currency != "" {
+			mapping.Schema = LegacySchema
+		}
+		mapping.mappings = append(mapping.mappings, columnMapping{column: found, currency: currency})
+	}
+
+	for _, required := range requiredColumns {
+		if _, ok := mappedBy[findColumn(required)]; !ok {
+			return mapping, merry.Errorf("missing the '%s' column", required)
+		}
+	}
+	return mapping, nil
+}
+
+// GetColumnIndex returns the position in the file of the column known by
+// the given normalised name
+func (m *ColumnMapping) GetColumnIndex(name string) (int, bool) {
+	index, ok := m.indexes[findColumn(name)]
+	return index, ok
+}
+
+// ToRecordDTO reads a row of the file, the values are trimmed
+func (m *ColumnMapping) ToRecordDTO(row []string) RecordDTO {
+	dto := RecordDTO{}
+	for i, value := range row {
+		if i >= len(m.mappings) {
+			break
+		}
+		value = strings.TrimSpace(value)
+
+		columnMapping := m.mappings[i]
+		if columnMapping.column == nil {
+			if value != "" {
+				if dto.Extra == nil {
+					dto.Extra = map[string]string{}
+				}
+				dto.Extra[columnMapping.extra] = value
+			}
+			continue
+		}
+
+		columnMapping.column.set(&dto, value)
+		if columnMapping.currency != "" {
+			columnMapping.column.setCurrency(&dto, columnMapping.currency)
+		}
+	}
+	return dto
+}
@@ -0,0 +1,127 @@
+package trading212
+
+import (
+	"slices"
+	"time"
+
+	"github.com/ansel1/merry/v2"
+	"github.com/go-logr/logr"
+	"github.com/shopspring/decimal"
+)
+
+// StockSplitConflictWindow is how close a split in the corporate actions can
+// be to the split rows of an export before they are taken to be the same
+// split
+const StockSplitConflictWindow = 7 * 24 * time.Hour
+
+// IsStockSplit is true for the rows Trading 212 adds when a stock splits, the
+// close row holds the shares before the split and the open row the shares
+// after it
+func (r *Record) IsStockSplit() bool {
+	return r.IsStockSplitOpen() || r.IsStockSplitClose()
+}
+
+func (r *Record) IsStockSplitOpen() bool {
+	return r.Action == StockSplitOpen
+}
+
+func (r *Record) IsStockSplitClose() bool {
+	return r.Action == StockSplitClose
+}
+
+// Rescale changes the quantity of the record by the ratio, keeping its cost
+func (r *Record) Rescale(ratio decimal.Decimal) {
+	r.NoOfShares = r.NoOfShares.Mul(ratio)
+	r.PriceShare = r.PriceShare.Div(ratio)
+	r.DeemedDisposalTaxPerShare = r.DeemedDisposalTaxPerShare.Div(ratio)
+	r.SplitAdjusted.Done = true
+}
+
+// processStockSplit pairs the open and close rows of a split and rescales the
+// lots held before it
+func (q *PurchaseHistoryStruct) processStockSplit(log logr.Logger, record *Record) error {
+	if q.pendingSplit == nil {
+		q.pendingSplit = record
+		return nil
+	}
+
+	closeRecord, openRecord := q.pendingSplit, record
+	if record.IsStockSplitClose() {
+		closeRecord, openRecord = record, q.pendingSplit
+	}
+	if !closeRecord.IsStockSplitClose() || !openRecord.IsStockSplitOpen() {
+		return merry.Errorf("stock split rows are not paired: '%s' and '%s'",
+			q.pendingSplit.ID, record.ID)
+	}
+	q.pendingSplit = nil
+
+	if !closeRecord.NoOfShares.IsPositive() || !openRecord.NoOfShares.IsPositive() {
+		return merry.Errorf("stock split rows '%s' and '%s' have no shares",
+			closeRecord.ID, openRecord.ID)
+	}
+	ratio := openRecord.NoOfShares.Div(closeRecord.NoOfShares)
+
+	lots := []*Record{}
+	held := decimal.NewFromInt(0)
+	for _, lot := range q.recordQueue.GetQueue() {
+		if lot.Time.After(openRecord.Time) {
+			continue
+		}
+		held = held.Add(lot.NoOfShares)
+		lots = append(lots, lot)
+	}
+	// rescaling a different number of shares would change their cost basis
+	if !held.Equal(closeRecord.NoOfShares) {
+		return merry.Errorf("stock split row '%s' closes %s shares of '%s' but %s are held",
+			closeRecord.ID, closeRecord.NoOfShares, closeRecord.Ticker, held)
+	}
+	for _, lot := range lots {
+		lot.Rescale(ratio)
+	}
+
+	for _, candidate := range q.washSaleCandidates {
+		candidate.quantity = candidate.quantity.Mul(ratio)
+		candidate.unmatched = candidate.unmatched.Mul(ratio)
+	}
+
+	log.V(1).Info("stock split",
+		"ticker", openRecord.Ticker,
+		"date", openRecord.Time.String(),
+		"ratio", ratio,
+		"before", closeRecord.NoOfShares,
+		"after", openRecord.NoOfShares)
+	return nil
+}
+
+// GetPendingSplit returns the stock split row still waiting for the other row
+// of its pair, nil if there is none
+func (q *PurchaseHistoryStruct) GetPendingSplit() *Record {
+	return q.pendingSplit
+}
+
+// CheckPendingSplits returns an error for the stock split rows whose other
+// row was never seen, to be called at the end of the input
+func (b *BookKeeperStruct) CheckPendingSplits() error {
+	keys := make([]string, 0, len(b.book))
+	for key := range b.book {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	for _, key := range keys {
+		pendingSplit := b.book[key].GetPendingSplit()
+		if pendingSplit != nil {
+			return merry.Errorf("stock split row '%s' for '%s' on %s has no matching %s row",
+				pendingSplit.ID, pendingSplit.Ticker, pendingSplit.Time.Format(time.DateOnly),
+				getOtherSplitAction(pendingSplit.Action))
+		}
+	}
+	return nil
+}
+
+func getOtherSplitAction(action Action) Action {
+	if action == StockSplitOpen {
+		return StockSplitClose
+	}
+	return StockSplitOpen
+}
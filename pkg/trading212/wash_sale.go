@@ -0,0 +1,103 @@
+package trading212
+
+import (
+	"github.com/go-logr/logr"
+	"github.com/shopspring/decimal"
+)
+
+// washSaleCandidate is a losing disposal whose shares may still be
+// reacquired within the 4 weeks after the sale
+type washSaleCandidate struct {
+	disposal *Disposal
+	// quantity is the quantity disposed of, in the shares currently held as
+	// it is rescaled by stock splits
+	quantity decimal.Decimal
+	// unmatched is the quantity disposed of that has not been reacquired yet
+	unmatched decimal.Decimal
+}
+
+func (c *washSaleCandidate) inWindow(buyRecord *Record) bool {
+	return TimeIsBetween(buyRecord.Time, c.disposal.Date, c.disposal.Date.AddDate(0, 0, 7*4))
+}
+
+// ringFenceLosses applies s581(3) to a new acquisition.
+// Where shares are reacquired within 4 weeks after a losing disposal, the
+// loss is not allowable except against a gain on the disposal of the shares
+// reacquired. The restricted part of the loss is proportional to the
+// quantity reacquired and is moved into a pot held on the new lot.
+func (q *PurchaseHistoryStruct) ringFenceLosses(log logr.Logger, buyRecord *Record) error {
+	toMatch := buyRecord.NoOfShares
+
+	candidates := []*washSaleCandidate{}
+	for _, candidate := range q.washSaleCandidates {
+		if !candidate.inWindow(buyRecord) {
+			// the 4 weeks after this disposal are over, the shares not
+			// reacquired by then never will be so the candidate is dropped
+			continue
+		}
+
+		if toMatch.GreaterThan(decimal.NewFromInt(0)) {
+			reacquired := decimal.Min(candidate.unmatched, toMatch)
+			restricted := candidate.disposal.Profit.Mul(reacquired).Div(candidate.quantity)
+
+			candidate.unmatched = candidate.unmatched.Sub(reacquired)
+			toMatch = toMatch.Sub(reacquired)
+
+			buyRecord.RingFencedLoss = buyRecord.RingFencedLoss.Add(restricted)
+			candidate.disposal.RestrictedLoss = candidate.disposal.RestrictedLoss.Add(restricted)
+
+			// the restricted part is no longer an allowable loss for the
+			// period of the original disposal
+			taxPeriod := GetTaxPeriod(candidate.disposal.Date)
+			disposalType := candidate.disposal.Type
+			err := addToSummary(q.profits, taxPeriod, disposalType, restricted.Neg())
+			if err != nil {
+				return err
+			}
+			err = addToSummary(q.lossAggregates, taxPeriod, disposalType, restricted.Neg())
+			if err != nil {
+				return err
+			}
+			err = addToSummary(q.restrictedLossAggregates, taxPeriod, disposalType, restricted)
+			if err != nil {
+				return err
+			}
+
+			log.V(1).Info("loss ring-fenced",
+				"ticker", buyRecord.Ticker,
+				"disposalDate", candidate.disposal.Date.String(),
+				"reacquiredDate", buyRecord.Time.String(),
+				"reacquired", reacquired.String(),
+				"restrictedLoss", restricted.String())
+		}
+
+		if candidate.unmatched.GreaterThan(decimal.NewFromInt(0)) {
+			candidates = append(candidates, candidate)
+		}
+	}
+	q.washSaleCandidates = candidates
+
+	return nil
+}
+
+// releaseRingFencedLoss takes the share of the lot's ring-fenced loss for the
+// quantity being disposed of (out of the lot quantity held before the
+// disposal) and offsets it against the gain made on those shares. Whatever
+// cannot be offset is forfeited, as the pot can only ever be used against the
+// shares it is tied to.
+func releaseRingFencedLoss(buyRecord *Record, lotQuantity, quantity,
+	gain decimal.Decimal) (used, forfeited decimal.Decimal) {
+	if buyRecord.RingFencedLoss.IsZero() || lotQuantity.IsZero() {
+		return decimal.NewFromInt(0), decimal.NewFromInt(0)
+	}
+
+	pot := buyRecord.RingFencedLoss.Mul(quantity).Div(lotQuantity)
+	buyRecord.RingFencedLoss = buyRecord.RingFencedLoss.Sub(pot)
+
+	used = decimal.NewFromInt(0)
+	if gain.GreaterThan(decimal.NewFromInt(0)) {
+		// both are negative, so the smaller offset is the larger value
+		used = decimal.Max(pot, gain.Neg())
+	}
+	return used, pot.Sub(used)
+}
@@ -0,0 +1,254 @@
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/shopspring/decimal"
+	"trading212-parser.kimi450.com/pkg/config"
+	"trading212-parser.kimi450.com/pkg/tax"
+	"trading212-parser.kimi450.com/pkg/trading212"
+)
+
+type Severity string
+
+const (
+	// ErrorSeverity is a problem that would stop the run or give wrong
+	// figures
+	ErrorSeverity   Severity = "error"
+	WarningSeverity Severity = "warning"
+)
+
+// ValidationIssue is a problem found in the inputs, Line is 0 when it is
+// not about a row
+type ValidationIssue struct {
+	Severity Severity
+	Path     string
+	Line     int
+	Message  string
+}
+
+type ValidationReport struct {
+	Issues []ValidationIssue
+}
+
+// totalTolerance is the difference allowed between the Total and the value
+// worked out from the shares, price and rate, as a fraction of the Total
+var totalTolerance = decimal.RequireFromString("0.01")
+
+func (r *ValidationReport) add(severity Severity, path string, line int, format string, args ...any) {
+	r.Issues = append(r.Issues, ValidationIssue{
+		Severity: severity,
+		Path:     path,
+		Line:     line,
+		Message:  fmt.Sprintf(format, args...),
+	})
+}
+
+// HasErrors is true if any of the issues is blocking
+func (r *ValidationReport) HasErrors() bool {
+	for _, issue := range r.Issues {
+		if issue.Severity == ErrorSeverity {
+			return true
+		}
+	}
+	return false
+}
+
+// validateInputs reads every input in lenient mode and checks the records
+// without computing any tax. The holdings are checked up to the as of date,
+// only if every input could be read.
+func validateInputs(log logr.Logger, configData config.Config, asOf time.Time) ValidationReport {
+	report := ValidationReport{}
+	// readAll is false when an input could not be read, the holdings would
+	// be missing its records
+	readAll := true
+
+	referenceData, err := loadReferenceData(configData, tax.NewParameterTable(configData.TaxParameters))
+	if err != nil {
+		report.add(ErrorSeverity, "", 0, "%v", err)
+		readAll = false
+	}
+
+	records := []trading212.Record{}
+	// badRows are the rows with values that were zeroed, by path and line
+	badRows := map[string]bool{}
+	deduplicator := trading212.NewRecordDeduplicator()
+	addRecords := func(sourceRecords []trading212.Record, source string) {
+		for _, record := range sourceRecords {
+			if record.Source == "" {
+				record.Source = source
+			}
+			added, err := deduplicator.Add(record, source)
+			if err != nil {
+				report.add(ErrorSeverity, source, record.Line, "%v", err)
+				continue
+			}
+			if !added {
+				report.add(WarningSeverity, source, record.Line,
+					"duplicate of a row already read, it is dropped")
+				continue
+			}
+			records = append(records, record)
+		}
+	}
+
+	if configData.OpeningLotsFile != "" {
+		openingLots, err := trading212.LoadOpeningLots(configData.OpeningLotsFile)
+		if err != nil {
+			report.add(ErrorSeverity, configData.OpeningLotsFile, 0, "%v", err)
+			readAll = false
+		}
+		addRecords(openingLots, configData.OpeningLotsFile)
+	}
+
+	historyFiles, err := configData.GetHistoryFiles()
+	if err != nil {
+		report.add(ErrorSeverity, "", 0, "%v", err)
+		readAll = false
+	}
+	for _, historyFile := range historyFiles {
+		fileRecords, _, cellErrors, err := readHistoryFile(historyFile, true)
+		if err != nil {
+			cellError := trading212.CellError{}
+			line := 0
+			if errors.As(err, &cellError) {
+				line = cellError.Line
+			}
+			report.add(ErrorSeverity, historyFile.Path, line, "%v", err)
+			readAll = false
+		}
+		for _, cellError := range cellErrors {
+			report.add(ErrorSeverity, cellError.Path, cellError.Line, "column %d '%s' has the invalid value '%s'",
+				cellError.Column, cellError.Header, cellError.Value)
+			badRows[fmt.Sprintf("%s:%d", cellError.Path, cellError.Line)] = true
+		}
+		for _, record := range fileRecords {
+			if historyFile.Year != 0 && record.Time.Year() != historyFile.Year {
+				report.add(WarningSeverity, historyFile.Path, record.Line,
+					"row is in %d, outside the year %d declared for the file", record.Time.Year(), historyFile.Year)
+			}
+		}
+		addRecords(fileRecords, historyFile.Path)
+	}
+
+	if configData.ManualTransactionsFile != "" {
+		manualTransactions, err := trading212.LoadManualTransactions(configData.ManualTransactionsFile)
+		if err != nil {
+			report.add(ErrorSeverity, configData.ManualTransactionsFile, 0, "%v", err)
+			readAll = false
+		}
+		manualRecords := []trading212.Record{}
+		for _, transaction := range manualTransactions {
+			manualRecords = append(manualRecords, transaction.Record)
+		}
+		addRecords(manualRecords, configData.ManualTransactionsFile)
+	}
+
+	trading212.SortRecords(records)
+	validateRecords(&report, records, badRows)
+	if !readAll {
+		report.add(WarningSeverity, "", 0, "the holdings are not checked, as not every input could be read")
+		return report
+	}
+	validateHoldings(log, &report, trading212.NewBookkeeperFromReferenceData(referenceData), records, asOf)
+	return report
+}
+
+// validateRecords checks the amounts of the buys and sells. The amounts of
+// the bad rows are not checked as they are already reported.
+func validateRecords(report *ValidationReport, records []trading212.Record, badRows map[string]bool) {
+	for _, record := range records {
+		buy := record.Action.IsBuy()
+		if (buy || record.Action.IsSell()) && !badRows[fmt.Sprintf("%s:%d", record.Source, record.Line)] {
+			validateAmounts(report, record, buy)
+		}
+	}
+}
+
+// validateHoldings runs the records through the bookkeeper, then the
+// corporate actions and deemed disposals up to the as of date, as the tax
+// calculation does. The records must be in processing order.
+func validateHoldings(log logr.Logger, report *ValidationReport, bookkeeper trading212.BookKeeper,
+	records []trading212.Record, asOf time.Time) {
+	for _, record := range records {
+		// the unknown actions are already reported as bad values
+		if record.Action.GetKind() == trading212.UnknownKind {
+			continue
+		}
+
+		if record.ExchangeRate.IsZero() {
+			// the missing rate is already reported, the holdings are still
+			// checked
+			record.ExchangeRate = decimal.NewFromInt(1)
+		}
+
+		err := bookkeeper.FindOrCreateEntryAndProcess(log, record)
+		if err != nil {
+			report.add(ErrorSeverity, record.Source, record.Line, "%v", err)
+		}
+	}
+
+	err := bookkeeper.CheckPendingSplits()
+	if err != nil {
+		report.add(ErrorSeverity, "", 0, "%v", err)
+	}
+	err = bookkeeper.ProcessCorporateActions(log, asOf)
+	if err != nil {
+		report.add(ErrorSeverity, "", 0, "%v", err)
+	}
+	err = bookkeeper.ProcessDeemedDisposals(log, asOf)
+	if err != nil {
+		report.add(ErrorSeverity, "", 0, "%v", err)
+	}
+	for _, collision := range bookkeeper.GetTickerCollisions() {
+		report.add(WarningSeverity, "", 0,
+			"ticker '%s' of ISIN '%s' on %s is already held under ISIN '%s', add an isin-change if they are "+
+				"the same shares", collision.Ticker, collision.Isin, collision.Date.Format(time.DateOnly),
+			collision.HeldIsin)
+	}
+}
+
+// validateAmounts checks that a buy or sell has an exchange rate and that
+// its Total matches the shares, price, rate and conversion fee
+func validateAmounts(report *ValidationReport, record trading212.Record, buy bool) {
+	if record.ExchangeRate.IsZero() {
+		report.add(ErrorSeverity, record.Source, record.Line, "missing exchange rate")
+		return
+	}
+	if record.Total.IsZero() {
+		return
+	}
+
+	expected := record.NoOfShares.Mul(record.PriceShare).Div(record.ExchangeRate)
+	if buy {
+		expected = expected.Add(record.CurrencyConversionFee).Add(record.StampDutyReserveTax)
+	} else {
+		expected = expected.Sub(record.CurrencyConversionFee)
+	}
+
+	if expected.Sub(record.Total).Abs().GreaterThan(record.Total.Abs().Mul(totalTolerance)) {
+		report.add(WarningSeverity, record.Source, record.Line,
+			"Total %s does not match shares × price / rate = %s", record.Total, expected.Round(2))
+	}
+}
+
+// logValidationReport logs every issue with its file and line
+func logValidationReport(log logr.Logger, report ValidationReport) {
+	errorCount, warningCount := 0, 0
+	for _, issue := range report.Issues {
+		if issue.Severity == ErrorSeverity {
+			errorCount++
+		} else {
+			warningCount++
+		}
+		log.V(0).Info(fmt.Sprintf("%s: %s", strings.ToUpper(string(issue.Severity)), issue.Message),
+			"path", issue.Path,
+			"line", issue.Line,
+		)
+	}
+	log.V(0).Info("validation finished", "errors", errorCount, "warnings", warningCount)
+}